@@ -0,0 +1,194 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	accessLogPath    = flag.String("access-log", "", "write one Combined Log Format line per connection to this file; reopened on SIGHUP")
+	accessLogMaxSize = flag.Int64("access-log-max-size", 0, "rotate the access log once it reaches this many bytes, gzip-compressing the old file; 0 to never rotate")
+)
+
+// accessLog is nil unless -access-log is set.
+var accessLog *log.Logger
+
+// reopenableFile is an append-only file that can be reopened in place, so
+// external tools like logrotate can move it away and signal the proxy. With
+// maxSize set it also rotates itself.
+type reopenableFile struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openReopenableFile(path string, maxSize int64) (*reopenableFile, error) {
+	f := &reopenableFile{path: path, maxSize: maxSize}
+	if err := f.reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *reopenableFile) reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	f.mu.Lock()
+	old := f.file
+	f.file = file
+	f.size = size
+	f.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (f *reopenableFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			log.Printf("Error rotating %s: %v", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside, starts a new one and compresses the
+// old one in the background. f.mu must be held.
+func (f *reopenableFile) rotate() error {
+	rotated := rotatedName(f.path, time.Now())
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	f.file.Close()
+	f.file = file
+	f.size = 0
+
+	go func() {
+		if err := gzipFile(rotated); err != nil {
+			log.Printf("Error compressing %s: %v", rotated, err)
+		}
+	}()
+	return nil
+}
+
+// rotatedName returns the name path is renamed to when it is rotated at now:
+// path with a timestamp, plus a sequence number if rotations in the same
+// millisecond left that name, or its compressed copy, behind already.
+func rotatedName(path string, now time.Time) string {
+	base := path + "." + now.Format("20060102-150405.000")
+	name := base
+	for seq := 1; fileExists(name) || fileExists(name+".gz"); seq++ {
+		name = fmt.Sprintf("%s.%d", base, seq)
+	}
+	return name
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// gzipFile compresses path to path.gz and removes path.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+// openLogFile opens path for appending through a logger and reopens it on
+// every SIGHUP. A maxSize above 0 rotates the file once it grows that large.
+func openLogFile(path string, maxSize int64) (*log.Logger, error) {
+	file, err := openReopenableFile(path, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGHUP)
+	go func() {
+		for range reopen {
+			if err := file.reopen(); err != nil {
+				log.Printf("Error reopening %s: %v", path, err)
+			}
+		}
+	}()
+	return log.New(file, "", 0), nil
+}
+
+// writeAccessLog writes stats for a connection started at start as a line in
+// Combined Log Format. Referer is always "-", since tunnels carry none.
+func writeAccessLog(stats Stats, start time.Time) {
+	if accessLog == nil {
+		return
+	}
+	status := "-"
+	if stats.Status != 0 {
+		status = strconv.Itoa(stats.Status)
+	}
+	accessLog.Printf(
+		"%s - - [%s] %s %s %d \"-\" %s",
+		stats.ClientIP,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		clfQuote(stats.request),
+		status,
+		stats.BytesOut,
+		clfQuote(stats.userAgent),
+	)
+}
+
+// clfQuote quotes a Combined Log Format field, using "-" for empty values.
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return fmt.Sprintf("%q", s)
+}
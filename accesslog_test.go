@@ -0,0 +1,172 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAccessLog sends the access log to a buffer for the test.
+func useAccessLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	accessLog = log.New(buf, "", 0)
+	t.Cleanup(func() { accessLog = nil })
+	return buf
+}
+
+func TestWriteAccessLog(t *testing.T) {
+	buf := useAccessLog(t)
+	start := time.Date(2024, 3, 5, 14, 7, 9, 0, time.FixedZone("", 2*3600))
+
+	writeAccessLog(Stats{
+		ClientIP:  "10.0.0.1",
+		BytesOut:  5120,
+		Status:    200,
+		request:   "CONNECT example.com:443 HTTP/1.1",
+		userAgent: `curl/8.0 "quoted"`,
+	}, start)
+	writeAccessLog(Stats{ClientIP: "10.0.0.2"}, start)
+
+	want := `10.0.0.1 - - [05/Mar/2024:14:07:09 +0200] "CONNECT example.com:443 HTTP/1.1" 200 5120 "-" "curl/8.0 \"quoted\""` + "\n" +
+		`10.0.0.2 - - [05/Mar/2024:14:07:09 +0200] "-" - 0 "-" "-"` + "\n"
+	if buf.String() != want {
+		t.Errorf("access log:\n%s\nwant:\n%s", buf, want)
+	}
+}
+
+func TestAccessLogPerConnection(t *testing.T) {
+	buf := useAccessLog(t)
+	proxy := startProxy(t, handleClientConnection)
+
+	sendRaw(t, proxy, "GET / HTTP/1.1\r\nHost: proxy\r\nUser-Agent: probe/1\r\n\r\n")
+	for deadline := time.Now().Add(2 * time.Second); buf.String() == "" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	line := buf.String()
+	if !strings.HasPrefix(line, "127.0.0.1 - - [") || !strings.Contains(line, `] "GET / HTTP/1.1" 405 `) ||
+		!strings.HasSuffix(line, ` "-" "probe/1"`+"\n") {
+		t.Errorf("access log line %q", line)
+	}
+	if strings.Count(line, "\n") != 1 {
+		t.Errorf("want one line per connection, got %q", line)
+	}
+}
+
+func TestReopenableFileRotates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := openReopenableFile(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+
+	line := strings.Repeat("a", 59) + "\n"
+	f.Write([]byte(line))
+	f.Write([]byte(line)) // over 100 bytes: rotates first
+	data, _ := os.ReadFile(path)
+	if string(data) != line {
+		t.Errorf("current file holds %q, want only the last line", data)
+	}
+
+	// the rotated file is compressed in the background; the .gz exists
+	// before it is complete, so wait until the plain file is gone
+	var gzipped, plain []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		gzipped, _ = filepath.Glob(path + ".*.gz")
+		plain, _ = filepath.Glob(path + ".*[0-9]")
+		if len(gzipped) == 1 && len(plain) == 0 {
+			break
+		}
+	}
+	if len(gzipped) != 1 || len(plain) != 0 {
+		entries, _ := os.ReadDir(dir)
+		t.Fatalf("rotation not compressed; directory: %v", entries)
+	}
+	in, err := os.Open(gzipped[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated, _ := io.ReadAll(zr); string(rotated) != line {
+		t.Errorf("rotated file holds %q", rotated)
+	}
+}
+
+func TestReopenableFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := openReopenableFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+	f.Write([]byte("before\n"))
+
+	// logrotate moves the file away, then the proxy reopens it
+	os.Rename(path, path+".1")
+	if err := f.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("after\n"))
+	if data, _ := os.ReadFile(path); string(data) != "after\n" {
+		t.Errorf("new file holds %q", data)
+	}
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "before\n" {
+		t.Errorf("moved file holds %q", data)
+	}
+}
+
+func TestRotatedNameUnique(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	base := path + ".20240101-120000.000"
+
+	if got := rotatedName(path, now); got != base {
+		t.Errorf("first rotation named %q, want %q", got, base)
+	}
+	// one rotation in this millisecond is still plain, one already gzipped
+	os.WriteFile(base, nil, 0o644)
+	os.WriteFile(base+".1.gz", nil, 0o644)
+	if got := rotatedName(path, now); got != base+".2" {
+		t.Errorf("rotation in the same millisecond named %q, want %q", got, base+".2")
+	}
+}
+
+func TestReopenableFileRotatesInBursts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := openReopenableFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+
+	// every write rotates, many within the same millisecond
+	const writes = 20
+	for i := 0; i < writes; i++ {
+		f.Write([]byte(strings.Repeat("a", 9) + "\n"))
+	}
+	var rotations, plain []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rotations, _ = filepath.Glob(path + ".*.gz")
+		plain, _ = filepath.Glob(path + ".*[0-9]")
+		if len(rotations) == writes-1 && len(plain) == 0 {
+			break
+		}
+	}
+	if len(rotations) != writes-1 || len(plain) != 0 {
+		entries, _ := os.ReadDir(dir)
+		t.Errorf("%d compressed rotations, want %d; directory: %v", len(rotations), writes-1, entries)
+	}
+}
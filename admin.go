@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	adminAddr        = flag.String("admin-addr", "", `address for the JSON admin API, e.g. 127.0.0.1:9090 or "unix:/run/proxy-admin.sock"`)
+	adminAllowRemote = flag.Bool("admin-allow-remote", false, "allow the admin API to listen on, and accept clients from, non-loopback addresses")
+)
+
+// newAdminHandler returns the admin API:
+//
+//	GET    /conns      active connections
+//	GET    /stats      proxy counters
+//	GET    /debug/vars proxy counters and runtime stats in expvar format
+//	POST   /blacklist  {"host": "..."} adds a blacklist entry
+//	DELETE /blacklist  {"host": "..."} removes a blacklist entry
+//
+// Blacklist edits are kept over refreshes of a -blacklist URL.
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conns", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, snapshotConns())
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := metricsSnapshot()
+		stats["blacklist"] = int64(len(currentBlacklist()))
+		writeJSON(w, stats)
+	})
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("POST /blacklist", func(w http.ResponseWriter, r *http.Request) {
+		host, ok := readHostBody(w, r)
+		if !ok {
+			return
+		}
+		editBlacklist(host, true)
+		log.Printf("Admin: added %s to blacklist", host)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /blacklist", func(w http.ResponseWriter, r *http.Request) {
+		host, ok := readHostBody(w, r)
+		if !ok {
+			return
+		}
+		if !editBlacklist(host, false) {
+			http.Error(w, "host not in blacklist", http.StatusNotFound)
+			return
+		}
+		log.Printf("Admin: removed %s from blacklist", host)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	if *adminAllowRemote {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackClient(r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// readHostBody decodes a {"host": "..."} request body, answering 400 itself
+// if that fails.
+func readHostBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Host string `json:"host"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	host := strings.TrimSpace(body.Host)
+	if host == "" {
+		http.Error(w, `missing "host"`, http.StatusBadRequest)
+		return "", false
+	}
+	return host, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// isLoopbackClient reports whether remoteAddr is a loopback address. Unix
+// socket peers have no IP and count as local.
+func isLoopbackClient(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return !strings.Contains(remoteAddr, ".") && !strings.Contains(remoteAddr, ":")
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkLoopbackAddr returns an error unless addr is a unix socket or a
+// loopback host:port.
+func checkLoopbackAddr(addr string) error {
+	if strings.HasPrefix(addr, "unix:") {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// startAdmin serves the admin API on addr in the background.
+func startAdmin(addr string) error {
+	if !*adminAllowRemote {
+		if err := checkLoopbackAddr(addr); err != nil {
+			return fmt.Errorf("%w; use -admin-allow-remote to allow it", err)
+		}
+	}
+
+	listener, err := listenOn("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Admin API listening on %s", addr)
+	go func() {
+		err := http.Serve(listener, newAdminHandler())
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Admin API stopped: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminRequest sends a request to the admin API from a loopback client.
+func adminRequest(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:50000"
+	rec := httptest.NewRecorder()
+	newAdminHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+// resetAdminEdits forgets the admin edits made by the test.
+func resetAdminEdits(t *testing.T) {
+	t.Cleanup(func() {
+		blacklistUpdates.Lock()
+		adminEdits = make(map[string]bool)
+		blacklistUpdates.Unlock()
+	})
+}
+
+func TestAdminBlacklistEdits(t *testing.T) {
+	useBlacklist(t, "listed.example")
+	resetAdminEdits(t)
+
+	if rec := adminRequest(t, "POST", "/blacklist", `{"host": "added.example"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST: %d %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, "DELETE", "/blacklist", `{"host": "listed.example"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, "DELETE", "/blacklist", `{"host": "listed.example"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a missing host: %d, want 404", rec.Code)
+	}
+	if !isBlocked("added.example:443") || isBlocked("listed.example:443") {
+		t.Fatalf("edits not applied: %v", currentBlacklist())
+	}
+
+	// a refreshed list still carries the edits
+	storeBlacklist(map[string]*schedule{"listed.example": nil, "fresh.example": nil})
+	if !isBlocked("added.example:443") || isBlocked("listed.example:443") || !isBlocked("fresh.example:443") {
+		t.Errorf("edits lost on refresh: %v", currentBlacklist())
+	}
+}
+
+func TestAdminBadRequests(t *testing.T) {
+	for _, body := range []string{`{"host": ""}`, `not json`, `{}`} {
+		if rec := adminRequest(t, "POST", "/blacklist", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %s: %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	useBlacklist(t, "a.example", "b.example")
+	rec := adminRequest(t, "GET", "/stats", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /stats: %d %s", rec.Code, rec.Header())
+	}
+	var stats map[string]int64
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["blacklist"] != 2 {
+		t.Errorf("blacklist = %d, want 2", stats["blacklist"])
+	}
+
+	rec = adminRequest(t, "GET", "/conns", "")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "[") {
+		t.Errorf("GET /conns: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAdminRefusesRemoteClients(t *testing.T) {
+	req := httptest.NewRequest("GET", "/stats", nil)
+	req.RemoteAddr = "192.0.2.1:50000"
+	rec := httptest.NewRecorder()
+	newAdminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("remote client: %d, want 403", rec.Code)
+	}
+
+	setFlag(t, "admin-allow-remote", "true")
+	rec = httptest.NewRecorder()
+	newAdminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("remote client with -admin-allow-remote: %d, want 200", rec.Code)
+	}
+}
+
+func TestCheckLoopbackAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:9090":       true,
+		"[::1]:9090":           true,
+		"localhost:9090":       true,
+		"unix:/run/admin.sock": true,
+		":9090":                false,
+		"0.0.0.0:9090":         false,
+		"192.0.2.1:9090":       false,
+	} {
+		if err := checkLoopbackAddr(addr); (err == nil) != ok {
+			t.Errorf("checkLoopbackAddr(%q) = %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"time"
+)
+
+var auditLogPath = flag.String("audit-log", "", "write a JSON line to this file when each connection is connected, blocked, rejected or fails; reopened on SIGHUP")
+
+// auditLog is nil unless -audit-log is set.
+var auditLog *log.Logger
+
+// Audit decisions.
+const (
+	decisionConnected = "connected"
+	decisionBlocked   = "blocked"
+	decisionRejected  = "rejected"
+	decisionFailed    = "failed"
+)
+
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Conn      uint64    `json:"conn"`
+	Client    string    `json:"client"`
+	Target    string    `json:"target"`
+	Decision  string    `json:"decision"`
+	Rule      string    `json:"rule,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+}
+
+// audit records the fate of a connection accepted at start. rule names the
+// blacklist entry or limit responsible for a block or rejection.
+func audit(stats *Stats, decision, rule string, start time.Time) {
+	if auditLog == nil {
+		return
+	}
+	now := time.Now()
+	record, _ := json.Marshal(auditRecord{
+		Time:      now,
+		Conn:      stats.conn.id,
+		Client:    stats.ClientIP,
+		Target:    logHost(stats.Target),
+		Decision:  decision,
+		Rule:      rule,
+		LatencyMS: float64(now.Sub(start).Microseconds()) / 1000,
+	})
+	auditLog.Print(string(record))
+}
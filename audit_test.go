@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditRecords(t *testing.T) {
+	buf := &syncBuffer{}
+	auditLog = log.New(buf, "", 0)
+	t.Cleanup(func() { auditLog = nil })
+	useBlacklist(t, "bad.example")
+	allowedPorts = map[string]bool{"443": true}
+	t.Cleanup(func() { allowedPorts = nil })
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := listener.Addr().String()
+	listener.Close()
+	useRewrites(t, "echo.test="+startEcho(t)+",closed.test="+closed)
+	proxy := startProxy(t, handleClientConnection)
+
+	tests := []struct {
+		target, decision, rule string
+	}{
+		{"echo.test:443", decisionConnected, ""},
+		{"bad.example:443", decisionBlocked, "bad.example"},
+		{"echo.test:25", decisionRejected, "connect-ports"},
+		{"closed.test:443", decisionFailed, ""},
+	}
+	for _, tt := range tests {
+		conn, _, _ := connect(t, proxy, tt.target)
+		conn.Close()
+	}
+	for deadline := time.Now().Add(2 * time.Second); strings.Count(buf.String(), "\n") < len(tests) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("%d audit records, want %d:\n%s", len(lines), len(tests), buf)
+	}
+	for i, tt := range tests {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("record %q: %v", lines[i], err)
+		}
+		if record.Target != tt.target || record.Decision != tt.decision || record.Rule != tt.rule {
+			t.Errorf("record %q, want target %s, decision %s, rule %q", lines[i], tt.target, tt.decision, tt.rule)
+		}
+		if record.Client != "127.0.0.1" || record.Conn == 0 || record.Time.IsZero() {
+			t.Errorf("record %q lacks the client, conn id or time", lines[i])
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes content to name in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useBlacklist installs entries as the blacklist for the test.
+func useBlacklist(t *testing.T, entries ...string) {
+	t.Helper()
+	list := make(map[string]*schedule)
+	for _, entry := range entries {
+		list[entry] = nil
+	}
+	blacklist.Store(&list)
+	t.Cleanup(func() { blacklist.Store(nil) })
+}
+
+func TestEmptyBlacklistWarns(t *testing.T) {
+	defer blacklist.Store(nil)
+	logs := captureLog(t)
+	path := writeFile(t, t.TempDir(), "blacklist.txt", "# nothing blocked yet\n\n")
+	if err := loadStartupBlacklist(path); err != nil {
+		t.Fatal(err)
+	}
+	if !logged(logs, "blacklist is empty, all hosts are allowed") {
+		t.Errorf("no empty-blacklist warning; log: %s", logs)
+	}
+	if isBlocked("example.com:443") {
+		t.Error("example.com blocked by an empty blacklist")
+	}
+}
+
+func TestEmptyBlacklistDeny(t *testing.T) {
+	t.Cleanup(func() { blacklist.Store(nil) })
+	setFlag(t, "empty-blacklist", "deny")
+	logs := captureLog(t)
+	dir := t.TempDir()
+	path := writeFile(t, dir, "blacklist.txt", "# nothing blocked yet\n\n")
+	setFlag(t, "blacklist", path)
+	if err := loadStartupBlacklist(path); err != nil {
+		t.Fatal(err)
+	}
+	if !logged(logs, "blacklist is empty, all hosts are blocked") {
+		t.Errorf("no empty-blacklist warning; log: %s", logs)
+	}
+	if rule, blocked := matchBlacklist("example.com:443"); !blocked || rule != emptyBlacklistRule {
+		t.Errorf("matchBlacklist = %q, %v with an empty list and -empty-blacklist deny", rule, blocked)
+	}
+
+	// a missing file counts as empty
+	missing := filepath.Join(dir, "missing.txt")
+	setFlag(t, "blacklist", missing)
+	if err := loadStartupBlacklist(missing); err != nil {
+		t.Fatal(err)
+	}
+	if !logged(logs, "not found, all hosts are blocked") || !isBlocked("example.com:443") {
+		t.Errorf("missing blacklist with -empty-blacklist deny allows hosts; log: %s", logs)
+	}
+
+	// a non-empty list applies as usual
+	useBlacklist(t, "bad.example")
+	if isBlocked("example.com:443") || !isBlocked("bad.example:443") {
+		t.Error("-empty-blacklist deny changed a non-empty blacklist")
+	}
+
+	// without a blacklist there is nothing to be empty
+	blacklist.Store(nil)
+	setFlag(t, "blacklist", "")
+	if isBlocked("example.com:443") {
+		t.Error("-empty-blacklist deny blocks with the blacklist disabled")
+	}
+}
+
+func TestReadBlacklistFile(t *testing.T) {
+	dir := t.TempDir()
+	// includes are relative to the including file
+	writeFile(t, dir, "lists/ads.txt", "ads.example\ninclude more.txt\n")
+	writeFile(t, dir, "lists/more.txt", "tracker.example # inline comment\n")
+	path := writeFile(t, dir, "blacklist.txt", `# top-level list
+bad.example
+   spaced.example   
+
+include lists/ads.txt
+`)
+	list := make(map[string]*schedule)
+	if err := readBlacklistFile(path, list, make(map[string]bool)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"bad.example", "spaced.example", "ads.example", "tracker.example"}
+	if len(list) != len(want) {
+		t.Errorf("got %d entries %v, want %v", len(list), list, want)
+	}
+	for _, entry := range want {
+		if _, ok := list[entry]; !ok {
+			t.Errorf("%s missing from %v", entry, list)
+		}
+	}
+}
+
+func TestReadBlacklistFileIncludeLoop(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "b.txt", "b.example\ninclude a.txt\n")
+	path := writeFile(t, dir, "a.txt", "a.example\ninclude b.txt\n")
+	err := readBlacklistFile(path, make(map[string]*schedule), make(map[string]bool))
+	if err == nil || !strings.Contains(err.Error(), "include loop") {
+		t.Errorf("err = %v, want an include loop", err)
+	}
+
+	// the same file included twice without a cycle is fine
+	writeFile(t, dir, "common.txt", "common.example\n")
+	path = writeFile(t, dir, "twice.txt", "include common.txt\ninclude common.txt\n")
+	if err := readBlacklistFile(path, make(map[string]*schedule), make(map[string]bool)); err != nil {
+		t.Errorf("repeated include: %v", err)
+	}
+}
+
+func TestReadBlacklistFileMissingInclude(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "blacklist.txt", "include gone.txt\n")
+	err := readBlacklistFile(path, make(map[string]*schedule), make(map[string]bool))
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("err = %v, want an error that is not ErrNotExist", err)
+	}
+}
+
+func TestParseBlacklistWithoutInclude(t *testing.T) {
+	_, _, err := parseBlacklist(strings.NewReader("a.example\ninclude b.txt\n"), "url", false)
+	if err == nil || err.Error() != "url:2: include is not supported here" {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestMissingBlacklistWarns(t *testing.T) {
+	defer blacklist.Store(nil)
+	logs := captureLog(t)
+	path := filepath.Join(t.TempDir(), "blacklist.txt")
+	if err := loadStartupBlacklist(path); err != nil {
+		t.Fatalf("missing blacklist: %v", err)
+	}
+	if !logged(logs, "not found, all hosts are allowed") {
+		t.Errorf("no missing-blacklist warning; log: %s", logs)
+	}
+	if isBlocked("example.com:443") {
+		t.Error("example.com blocked without a blacklist")
+	}
+}
+
+func TestUnreadableBlacklistFails(t *testing.T) {
+	defer blacklist.Store(nil)
+	// a directory exists but can't be read as a list
+	if err := loadStartupBlacklist(t.TempDir()); err == nil {
+		t.Error("unreadable blacklist accepted")
+	}
+}
+
+// resetRemoteBlacklist forgets the validators of fetched lists.
+func resetRemoteBlacklist(t *testing.T) {
+	t.Cleanup(func() {
+		remoteBlacklist.mu.Lock()
+		remoteBlacklist.etag, remoteBlacklist.lastModified = "", ""
+		remoteBlacklist.mu.Unlock()
+		blacklist.Store(nil)
+	})
+}
+
+func TestFetchBlacklist(t *testing.T) {
+	resetRemoteBlacklist(t)
+	var requests []*http.Request
+	body := "bad.example\nworse.example # comment\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	if err := fetchBlacklist(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if !isBlocked("bad.example:443") || !isBlocked("worse.example:443") {
+		t.Fatalf("fetched list not applied: %v", currentBlacklist())
+	}
+	if ua := requests[0].Header.Get("User-Agent"); ua != proxyAgent() {
+		t.Errorf("User-Agent %q", ua)
+	}
+
+	// unchanged: the server answers 304 and the list stays
+	if err := fetchBlacklist(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || requests[1].Header.Get("If-None-Match") != `"v1"` {
+		t.Errorf("second fetch was not conditional")
+	}
+	if len(currentBlacklist()) != 2 {
+		t.Errorf("list changed on 304: %v", currentBlacklist())
+	}
+}
+
+func TestFetchBlacklistKeepsListOnError(t *testing.T) {
+	resetRemoteBlacklist(t)
+	useBlacklist(t, "kept.example")
+	for _, handler := range []http.HandlerFunc{
+		func(w http.ResponseWriter, r *http.Request) { http.Error(w, "down", http.StatusInternalServerError) },
+		func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "a.example\ninclude other.txt\n") },
+		func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "a.example @someday\n") },
+	} {
+		server := httptest.NewServer(handler)
+		if err := fetchBlacklist(server.URL); err == nil {
+			t.Error("bad fetch accepted")
+		}
+		server.Close()
+		if !isBlocked("kept.example:443") {
+			t.Fatal("current list replaced after a failed fetch")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var blacklistRefresh = flag.Duration("blacklist-refresh", 10*time.Minute, "how often to re-fetch a -blacklist given as an http(s):// URL, 0 to fetch only at startup")
+
+// maxBlacklistDownload bounds the size of a fetched blacklist.
+const maxBlacklistDownload = 64 << 20
+
+// remoteBlacklist holds the validators of the last fetched blacklist, so
+// unchanged lists aren't downloaded again.
+var remoteBlacklist struct {
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+}
+
+var blacklistClient = &http.Client{Timeout: time.Minute}
+
+// isBlacklistURL reports whether a -blacklist value is a URL rather than a file.
+func isBlacklistURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// fetchBlacklist downloads the blacklist at url and swaps it in. A 304 Not
+// Modified keeps the current list. On any error the current list is kept too.
+func fetchBlacklist(url string) error {
+	remoteBlacklist.mu.Lock()
+	defer remoteBlacklist.mu.Unlock()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", proxyAgent())
+	if remoteBlacklist.etag != "" {
+		req.Header.Set("If-None-Match", remoteBlacklist.etag)
+	}
+	if remoteBlacklist.lastModified != "" {
+		req.Header.Set("If-Modified-Since", remoteBlacklist.lastModified)
+	}
+	resp, err := blacklistClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil
+	default:
+		return fmt.Errorf("fetch %s: %s", url, resp.Status)
+	}
+
+	list, _, err := parseBlacklist(io.LimitReader(resp.Body, maxBlacklistDownload), url, false)
+	if err != nil {
+		return err
+	}
+
+	storeBlacklist(list)
+	remoteBlacklist.etag = resp.Header.Get("ETag")
+	remoteBlacklist.lastModified = resp.Header.Get("Last-Modified")
+	log.Printf("Fetched blacklist from %s: %d entries", url, len(list))
+	return nil
+}
+
+// refreshBlacklistLoop re-fetches the blacklist at url every interval. It
+// never returns.
+func refreshBlacklistLoop(url string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := fetchBlacklist(url); err != nil {
+			log.Printf("Error refreshing blacklist, keeping the previous list: %v", err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	breakerFailures = flag.Int("breaker-failures", 0, "consecutive dial failures to a target within -breaker-window that open its circuit, 0 to disable")
+	breakerWindow   = flag.Duration("breaker-window", time.Minute, "window in which -breaker-failures must happen")
+	breakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "how long an open circuit fails dials immediately before one probe dial is let through")
+)
+
+// errCircuitOpen is returned by dialTarget while a target's circuit is open.
+var errCircuitOpen = errors.New("circuit open after repeated dial failures")
+
+type breakerState struct {
+	failures  int
+	first     time.Time // first failure in the current window
+	openUntil time.Time
+	probing   bool // a half-open probe dial is in flight
+}
+
+// circuitBreaker fails dials to targets that keep failing. After failures
+// consecutive failures within window, a target's circuit opens and dials fail
+// immediately for cooldown. Then a single probe dial is let through: success
+// closes the circuit, failure opens it again.
+type circuitBreaker struct {
+	failures int
+	window   time.Duration
+	cooldown time.Duration
+
+	mu     sync.Mutex
+	states map[string]*breakerState
+}
+
+// targetBreaker is nil when -breaker-failures is 0.
+var targetBreaker *circuitBreaker
+
+func newCircuitBreaker(failures int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failures: failures,
+		window:   window,
+		cooldown: cooldown,
+		states:   make(map[string]*breakerState),
+	}
+}
+
+// allow reports whether a dial to target may go ahead, returning
+// errCircuitOpen if not.
+func (b *circuitBreaker) allow(target string, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.states[target]
+	if st == nil || st.openUntil.IsZero() {
+		return nil
+	}
+	if now.Before(st.openUntil) || st.probing {
+		return errCircuitOpen
+	}
+	st.probing = true
+	return nil
+}
+
+// record updates target's circuit with the result of a dial allowed by allow.
+func (b *circuitBreaker) record(target string, err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if st := b.states[target]; st != nil && !st.openUntil.IsZero() {
+			log.Printf("Circuit for %s closed", logHost(target))
+		}
+		delete(b.states, target)
+		return
+	}
+
+	st := b.states[target]
+	if st == nil {
+		st = &breakerState{}
+		b.states[target] = st
+	}
+	if !targetFault(err) {
+		st.probing = false
+		return
+	}
+	if st.probing {
+		st.probing = false
+		st.openUntil = now.Add(b.cooldown)
+		log.Printf("Circuit for %s reopened, probe dial failed", logHost(target))
+		return
+	}
+	if st.failures == 0 || now.Sub(st.first) > b.window {
+		st.failures = 0
+		st.first = now
+	}
+	st.failures++
+	if st.failures >= b.failures && st.openUntil.IsZero() {
+		st.openUntil = now.Add(b.cooldown)
+		log.Printf("Circuit for %s opened after %d dial failures", logHost(target), st.failures)
+	}
+}
+
+// sweep forgets targets whose failures are older than the window and whose
+// circuit is closed.
+func (b *circuitBreaker) sweep(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for target, st := range b.states {
+		if st.openUntil.IsZero() && now.Sub(st.first) > b.window {
+			delete(b.states, target)
+		}
+	}
+}
+
+// sweepLoop periodically forgets stale targets. It never returns.
+func (b *circuitBreaker) sweepLoop() {
+	for now := range time.Tick(b.window) {
+		b.sweep(now)
+	}
+}
+
+// targetFault reports whether a dial error counts against the target. It
+// doesn't when the client went away or the caller's ctx ran out (a bare
+// context error, unlike a dial timeout), when policy refused the dial, when
+// -max-upstream had no free slot, or when an upstream proxy failed.
+func targetFault(err error) bool {
+	var blocked *blockedDialError
+	var upstream *upstreamError
+	switch {
+	case errors.Is(err, context.Canceled), err == context.DeadlineExceeded:
+		return false
+	case errors.Is(err, errUpstreamLimit):
+		return false
+	case errors.As(err, &blocked), errors.As(err, &upstream):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(3, time.Minute, 30*time.Second)
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if err := b.allow("t:443", now); err != nil {
+			t.Fatalf("dial %d refused: %v", i+1, err)
+		}
+		b.record("t:443", errRefused, now)
+	}
+	if err := b.allow("t:443", now.Add(time.Second)); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("after 3 failures: %v, want errCircuitOpen", err)
+	}
+	if err := b.allow("other:443", now); err != nil {
+		t.Errorf("another target affected: %v", err)
+	}
+
+	// after the cooldown one probe goes through; a failed probe reopens
+	probe := now.Add(31 * time.Second)
+	if err := b.allow("t:443", probe); err != nil {
+		t.Fatalf("probe refused: %v", err)
+	}
+	if err := b.allow("t:443", probe); !errors.Is(err, errCircuitOpen) {
+		t.Error("second dial let through during the probe")
+	}
+	b.record("t:443", errRefused, probe)
+	if err := b.allow("t:443", probe.Add(time.Second)); !errors.Is(err, errCircuitOpen) {
+		t.Error("circuit closed by a failed probe")
+	}
+
+	// a successful probe closes the circuit
+	probe = probe.Add(31 * time.Second)
+	b.allow("t:443", probe)
+	b.record("t:443", nil, probe)
+	if err := b.allow("t:443", probe); err != nil {
+		t.Errorf("circuit still open after a successful probe: %v", err)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute, 30*time.Second)
+	now := time.Unix(1000, 0)
+	b.record("t:443", errRefused, now)
+	// the second failure is outside the window of the first
+	b.record("t:443", errRefused, now.Add(2*time.Minute))
+	if err := b.allow("t:443", now.Add(2*time.Minute)); err != nil {
+		t.Errorf("failures in different windows opened the circuit: %v", err)
+	}
+	b.sweep(now.Add(4 * time.Minute))
+	if len(b.states) != 0 {
+		t.Errorf("stale target not swept: %v", b.states)
+	}
+}
+
+func TestTargetFault(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errRefused, true},
+		{&net.OpError{Op: "dial", Err: &timeoutError{}}, true},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errUpstreamLimit, false},
+		{&blockedDialError{rule: "private:loopback"}, false},
+		{&upstreamError{errRefused}, false},
+	}
+	for _, tt := range tests {
+		if got := targetFault(tt.err); got != tt.want {
+			t.Errorf("targetFault(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	// excluded errors don't open the circuit
+	b := newCircuitBreaker(1, time.Minute, time.Minute)
+	b.record("t:443", errUpstreamLimit, time.Now())
+	if err := b.allow("t:443", time.Now()); err != nil {
+		t.Errorf("errUpstreamLimit opened the circuit: %v", err)
+	}
+}
+
+// timeoutError is a dial timeout, which does count against the target.
+type timeoutError struct{}
+
+func (*timeoutError) Error() string   { return "i/o timeout" }
+func (*timeoutError) Timeout() bool   { return true }
+func (*timeoutError) Temporary() bool { return true }
+
+func TestOpenCircuitAnswers503(t *testing.T) {
+	targetBreaker = newCircuitBreaker(1, time.Minute, time.Minute)
+	t.Cleanup(func() { targetBreaker = nil })
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := listener.Addr().String()
+	listener.Close()
+	proxy := startProxy(t, handleClientConnection)
+
+	if _, _, status := connect(t, proxy, closed); status != http.StatusBadGateway {
+		t.Errorf("refused dial: status %d, want 502", status)
+	}
+	if _, _, status := connect(t, proxy, closed); status != http.StatusServiceUnavailable {
+		t.Errorf("open circuit: status %d, want 503", status)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the environment variable of every flag.
+const envPrefix = "PROXY_"
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nEvery flag can also be set with a %s environment variable, e.g. -dial-timeout as %s.\n", envPrefix, envName("dial-timeout"))
+	}
+}
+
+// envName returns the environment variable for the flag name, e.g.
+// PROXY_DIAL_TIMEOUT for dial-timeout.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadEnv sets flags not given on the command line from their PROXY_
+// environment variables. PORT is still honored as ":$PORT" for -listen when
+// PROXY_LISTEN is unset.
+func loadEnv() error {
+	explicit := explicitFlags()
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok && f.Name == "listen" {
+			var port string
+			if port, ok = os.LookupEnv("PORT"); ok {
+				name, value = "PORT", ":"+port
+			}
+		}
+		if !ok {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: invalid value %q: %w", name, value, setErr)
+		}
+	})
+	return err
+}
+
+// explicitFlags returns the names of the flags set so far.
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// loadConfigFile applies the settings in a YAML file to the registered flags.
+// Keys are flag names, e.g. "transparent: true". Flags given on the command
+// line or through the environment take precedence over the file, and unknown
+// keys are only warned about.
+func loadConfigFile(path string) error {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	explicit := explicitFlags()
+	for key, value := range values {
+		if flag.Lookup(key) == nil {
+			log.Printf("Warning: unknown config key %q in %s", key, path)
+			continue
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := flag.Set(key, configValue(value)); err != nil {
+			return fmt.Errorf("%s: invalid value for %q: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+func readConfigFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// configString returns the value of key in the config file at path, or "" if
+// it is not set.
+func configString(path, key string) (string, error) {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return "", err
+	}
+	return configValue(values[key]), nil
+}
+
+// configValue renders a YAML value in the form its flag expects. Lists become
+// comma-separated strings.
+func configValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = configValue(item)
+		}
+		return strings.Join(parts, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
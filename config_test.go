@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file into a temporary directory.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// isolateFlags gives the test a command line on which no flag has been set
+// yet, sharing the flag values, since flag.Set can't be undone.
+func isolateFlags(t *testing.T) {
+	t.Helper()
+	commandLine := flag.CommandLine
+	isolated := flag.NewFlagSet(commandLine.Name(), flag.ContinueOnError)
+	commandLine.VisitAll(func(f *flag.Flag) {
+		isolated.Var(f.Value, f.Name, f.Usage)
+	})
+	flag.CommandLine = isolated
+	t.Cleanup(func() { flag.CommandLine = commandLine })
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	isolateFlags(t)
+	setFlag(t, "max-tunnels", "0")
+	setFlag(t, "redact-urls", "false")
+	setFlag(t, "connect-ports", "")
+	logs := captureLog(t)
+
+	path := writeConfig(t, `
+max-tunnels: 7
+redact-urls: true
+connect-ports: [443, 8443]
+no-such-flag: 1
+`)
+	if err := loadConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if *maxTunnels != 7 || !*redactURLs || *connectPorts != "443,8443" {
+		t.Errorf("got max-tunnels=%d redact-urls=%v connect-ports=%q", *maxTunnels, *redactURLs, *connectPorts)
+	}
+	if !logged(logs, `unknown config key "no-such-flag"`) {
+		t.Errorf("no warning for the unknown key; log: %s", logs)
+	}
+}
+
+func TestLoadConfigFileKeepsExplicitFlags(t *testing.T) {
+	isolateFlags(t)
+	setFlag(t, "max-header-count", "0")
+	// flag.Set marks the flag as given, like the command line does
+	if err := flag.Set("max-header-count", "12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(writeConfig(t, "max-header-count: 99\n")); err != nil {
+		t.Fatal(err)
+	}
+	if *maxHeaderCount != 12 {
+		t.Errorf("max-header-count = %d, want the explicit 12", *maxHeaderCount)
+	}
+}
+
+func TestLoadConfigFileInvalidValue(t *testing.T) {
+	isolateFlags(t)
+	setFlag(t, "accept-queue", "0")
+	err := loadConfigFile(writeConfig(t, "accept-queue: many\n"))
+	if err == nil || !strings.Contains(err.Error(), `"accept-queue"`) {
+		t.Errorf("err = %v, want an invalid value error for accept-queue", err)
+	}
+}
+
+func TestConfigString(t *testing.T) {
+	path := writeConfig(t, "listen: 127.0.0.1:9000\n")
+	if got, err := configString(path, "listen"); err != nil || got != "127.0.0.1:9000" {
+		t.Errorf("configString(listen) = %q, %v", got, err)
+	}
+	if got, err := configString(path, "missing"); err != nil || got != "" {
+		t.Errorf("configString(missing) = %q, %v", got, err)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := envName("dial-timeout"); got != "PROXY_DIAL_TIMEOUT" {
+		t.Errorf("envName = %q", got)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	isolateFlags(t)
+	setFlag(t, "max-tunnels", "0")
+	setFlag(t, "max-header-count", "0")
+	setFlag(t, "listen", "")
+	t.Setenv("PROXY_MAX_TUNNELS", "5")
+	t.Setenv("PROXY_MAX_HEADER_COUNT", "99")
+	t.Setenv("PORT", "8080")
+	// the command line wins over the environment
+	if err := flag.Set("max-header-count", "12"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if *maxTunnels != 5 {
+		t.Errorf("max-tunnels = %d, want 5 from PROXY_MAX_TUNNELS", *maxTunnels)
+	}
+	if *maxHeaderCount != 12 {
+		t.Errorf("max-header-count = %d, want the explicit 12", *maxHeaderCount)
+	}
+	if *listenAddr != ":8080" {
+		t.Errorf("listen = %q, want :8080 from PORT", *listenAddr)
+	}
+}
+
+func TestLoadEnvPrefersProxyListen(t *testing.T) {
+	isolateFlags(t)
+	setFlag(t, "listen", "")
+	t.Setenv("PORT", "8080")
+	t.Setenv("PROXY_LISTEN", "127.0.0.1:9000")
+	if err := loadEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if *listenAddr != "127.0.0.1:9000" {
+		t.Errorf("listen = %q, want PROXY_LISTEN", *listenAddr)
+	}
+}
+
+func TestLoadEnvInvalidValue(t *testing.T) {
+	isolateFlags(t)
+	setFlag(t, "accept-queue", "0")
+	t.Setenv("PROXY_ACCEPT_QUEUE", "many")
+	err := loadEnv()
+	if err == nil || !strings.Contains(err.Error(), "PROXY_ACCEPT_QUEUE") {
+		t.Errorf("err = %v, want one naming PROXY_ACCEPT_QUEUE", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedConn is the registry entry of an active connection.
+type trackedConn struct {
+	id       uint64
+	clientIP string
+	start    time.Time
+
+	mu      sync.Mutex
+	target  string
+	counter *countingConn // set once the tunnel starts
+}
+
+// connSnapshot is a point-in-time view of an active connection.
+type connSnapshot struct {
+	ID         uint64  `json:"id"`
+	Client     string  `json:"client"`
+	Target     string  `json:"target,omitempty"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out"`
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+var (
+	nextConnID  atomic.Uint64
+	activeConns sync.Map // id -> *trackedConn
+)
+
+// trackConn registers a newly accepted connection from clientIP.
+func trackConn(clientIP string) *trackedConn {
+	c := &trackedConn{
+		id:       nextConnID.Add(1),
+		clientIP: clientIP,
+		start:    time.Now(),
+	}
+	activeConns.Store(c.id, c)
+	return c
+}
+
+func (c *trackedConn) untrack() {
+	activeConns.Delete(c.id)
+}
+
+func (c *trackedConn) setTarget(target string) {
+	c.mu.Lock()
+	c.target = target
+	c.mu.Unlock()
+}
+
+// count wraps the client side of a tunnel so its bytes show up in snapshots.
+func (c *trackedConn) count(client net.Conn) net.Conn {
+	counter := &countingConn{Conn: client}
+	c.mu.Lock()
+	c.counter = counter
+	c.mu.Unlock()
+	return counter
+}
+
+func (c *trackedConn) snapshot(now time.Time) connSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := connSnapshot{
+		ID:         c.id,
+		Client:     c.clientIP,
+		Target:     logHost(c.target),
+		AgeSeconds: now.Sub(c.start).Seconds(),
+	}
+	if c.counter != nil {
+		s.BytesIn = atomic.LoadInt64(&c.counter.bytesRead)
+		s.BytesOut = atomic.LoadInt64(&c.counter.bytesWritten)
+	}
+	return s
+}
+
+// snapshotConns returns the active connections ordered by id.
+func snapshotConns() []connSnapshot {
+	now := time.Now()
+	snapshots := []connSnapshot{}
+	activeConns.Range(func(_, value any) bool {
+		snapshots = append(snapshots, value.(*trackedConn).snapshot(now))
+		return true
+	})
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID < snapshots[j].ID
+	})
+	return snapshots
+}
+
+// dumpConns logs every active connection; see dumpConnsOnUSR1.
+func dumpConns() {
+	snapshots := snapshotConns()
+	log.Printf("Active connections: %d", len(snapshots))
+	for _, s := range snapshots {
+		log.Printf("  conn=%d client=%s target=%s in=%d out=%d age=%s",
+			s.ID, s.Client, s.Target, s.BytesIn, s.BytesOut,
+			time.Duration(s.AgeSeconds*float64(time.Second)).Round(time.Second))
+	}
+}
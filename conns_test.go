@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTrackConn(t *testing.T) {
+	logs := captureLog(t)
+	c := trackConn("192.0.2.1")
+	c.setTarget("example.com:443")
+	client, peer := net.Pipe()
+	defer peer.Close()
+	counted := c.count(client)
+	go func() {
+		io.WriteString(peer, "hello")
+		io.ReadFull(peer, make([]byte, 3))
+	}()
+	io.ReadFull(counted, make([]byte, 5))
+	io.WriteString(counted, "abc")
+
+	var found *connSnapshot
+	for _, s := range snapshotConns() {
+		if s.ID == c.id {
+			found = &s
+		}
+	}
+	if found == nil {
+		t.Fatal("tracked connection missing from snapshotConns")
+	}
+	if found.Client != "192.0.2.1" || found.Target != "example.com:443" || found.BytesIn != 5 || found.BytesOut != 3 {
+		t.Errorf("snapshot = %+v", *found)
+	}
+
+	dumpConns()
+	if want := fmt.Sprintf("conn=%d client=192.0.2.1 target=example.com:443 in=5 out=3", c.id); !logged(logs, want) {
+		t.Errorf("dumpConns log lacks %q: %s", want, logs)
+	}
+
+	c.untrack()
+	for _, s := range snapshotConns() {
+		if s.ID == c.id {
+			t.Error("untracked connection still listed")
+		}
+	}
+}
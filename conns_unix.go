@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// dumpConnsOnUSR1 logs the active connections on every SIGUSR1.
+func dumpConnsOnUSR1() {
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	for range dump {
+		dumpConns()
+	}
+}
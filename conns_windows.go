@@ -0,0 +1,5 @@
+package main
+
+// dumpConnsOnUSR1 does nothing: Windows has no SIGUSR1. The admin API's
+// /conns endpoint shows the same snapshot.
+func dumpConnsOnUSR1() {}
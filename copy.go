@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"sync"
+)
+
+var copyBufferSize = flag.Int("copy-buffer-size", 32*1024, "size in bytes of the buffer used for each tunnel direction; larger favors throughput, smaller favors latency")
+
+// copyBuffers recycles tunnel copy buffers between connections.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, max(*copyBufferSize, 512))
+		return &buf
+	},
+}
+
+// copyPooled copies src to dst like io.Copy, using a pooled buffer of
+// -copy-buffer-size bytes.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// readSizes is a reader that records the size of each Read call. Like the
+// net.Conns of a tunnel, it implements no io.WriterTo, so io.CopyBuffer
+// uses the buffer.
+type readSizes struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (r *readSizes) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.r.Read(p)
+}
+
+// writerOnly hides any io.ReaderFrom of w.
+type writerOnly struct{ io.Writer }
+
+func TestCopyBufferSize(t *testing.T) {
+	for _, tt := range []struct{ flag, want int }{{1024, 1024}, {64 * 1024, 64 * 1024}, {1, 512}} {
+		setFlag(t, "copy-buffer-size", strconv.Itoa(tt.flag))
+		if buf := copyBuffers.New().(*[]byte); len(*buf) != tt.want {
+			t.Errorf("-copy-buffer-size=%d: buffer of %d bytes, want %d", tt.flag, len(*buf), tt.want)
+		}
+	}
+}
+
+func TestCopyPooled(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	src := &readSizes{r: bytes.NewReader(data)}
+	var dst bytes.Buffer
+	n, err := copyPooled(writerOnly{&dst}, src)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+		t.Fatalf("copied %d bytes, err %v; want %d bytes unchanged", n, err, len(data))
+	}
+	for _, size := range src.sizes {
+		if size != src.sizes[0] {
+			t.Errorf("read sizes %v, want one pooled buffer", src.sizes)
+			break
+		}
+	}
+}
+
+func BenchmarkCopyPooled(b *testing.B) {
+	for _, size := range []int{4 * 1024, 32 * 1024, 256 * 1024} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			old := *copyBufferSize
+			*copyBufferSize = size
+			defer func() { *copyBufferSize = old }()
+			// drop buffers of other sizes
+			copyBuffers = sync.Pool{New: copyBuffers.New}
+
+			data := make([]byte, 4<<20)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				src := bytes.NewReader(data)
+				copyPooled(writerOnly{io.Discard}, struct{ io.Reader }{src})
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	dialTimeout        = flag.Duration("dial-timeout", 0, "overall time budget for connecting to a target, including retries; 0 for no limit")
+	dialRetries        = flag.Int("dial-retries", 0, "number of times to retry a target dial after a transient failure")
+	dialBackoff        = flag.Duration("dial-backoff", 100*time.Millisecond, "delay before the first dial retry, doubled on each further retry")
+	maxUpstream        = flag.Int("max-upstream", 0, "maximum number of open upstream connections, 0 for unlimited; dials wait for a free slot within -dial-timeout")
+	happyEyeballs      = flag.Bool("happy-eyeballs", true, "race IPv6 and IPv4 connection attempts for dual-stack targets")
+	happyEyeballsDelay = flag.Duration("happy-eyeballs-delay", 300*time.Millisecond, "head start of the first address family before the other is tried")
+	sourceIP           = flag.String("source-ip", "", "local IP address to dial targets and upstream proxies from")
+)
+
+// sourceAddr is the parsed -source-ip, nil to let the system choose.
+var sourceAddr *net.TCPAddr
+
+// parseSourceIP parses ip and checks that it is assigned to this host by
+// binding to it.
+func parseSourceIP(ip string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+	local := &net.TCPAddr{IP: addr}
+	l, err := net.ListenTCP("tcp", local)
+	if err != nil {
+		return nil, err
+	}
+	l.Close()
+	return local, nil
+}
+
+// errUpstreamLimit is returned by dialTarget when no upstream slot became
+// free within the dial budget.
+var errUpstreamLimit = errors.New("too many upstream connections")
+
+// upstreamError wraps a failed dial through an upstream proxy. The proxy
+// itself may be at fault, so it doesn't count against the target's circuit.
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string { return e.err.Error() }
+func (e *upstreamError) Unwrap() error { return e.err }
+
+// upstreamSlots limits the number of open upstream connections; nil means
+// unlimited.
+var upstreamSlots chan struct{}
+
+// upstreamConn releases its upstream slot when closed.
+type upstreamConn struct {
+	net.Conn
+	release sync.Once
+}
+
+// Close closes the connection and frees its upstream slot.
+func (c *upstreamConn) Close() error {
+	err := c.Conn.Close()
+	c.release.Do(func() {
+		<-upstreamSlots
+	})
+	return err
+}
+
+// NetConn returns the wrapped connection.
+func (c *upstreamConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// dialTarget connects to hostPort, or its -rewrite replacement, through the
+// upstream of its -rules route if any, else through the environment's proxy
+// when -respect-env-proxy is set and one applies. With -breaker-failures it
+// fails fast with errCircuitOpen while hostPort's circuit is open.
+//
+// The address policy of -block-private and -geo-db applies to literal IP
+// targets whichever way they are dialed, and to the resolved addresses of
+// direct dials. Targets replaced by -rewrite are the operator's choice and
+// exempt.
+func dialTarget(ctx context.Context, hostPort string) (net.Conn, error) {
+	target := rewriteTarget(hostPort)
+	checkAddr := target == hostPort
+	if checkAddr {
+		if err := checkTargetAddr(withTargetDial(ctx), hostPort); err != nil {
+			return nil, err
+		}
+	}
+	hostPort = target
+	if targetBreaker == nil {
+		return dialTargetOnce(ctx, hostPort, checkAddr)
+	}
+	if err := targetBreaker.allow(hostPort, time.Now()); err != nil {
+		return nil, err
+	}
+	conn, err := dialTargetOnce(ctx, hostPort, checkAddr)
+	failure := err
+	if err != nil && ctx.Err() != nil {
+		failure = ctx.Err() // the dial was abandoned, not refused
+	}
+	targetBreaker.record(hostPort, failure, time.Now())
+	return conn, err
+}
+
+// dialTargetOnce dials hostPort once; checkAddr applies the address policy to
+// direct dials.
+func dialTargetOnce(ctx context.Context, hostPort string, checkAddr bool) (net.Conn, error) {
+	directCtx := ctx
+	if checkAddr {
+		directCtx = withTargetDial(ctx)
+	}
+	if route := matchRoute(hostPort); route != nil {
+		switch {
+		case route.upstream == nil:
+			return dialDirect(directCtx, hostPort)
+		case strings.HasPrefix(route.upstream.Scheme, "socks"):
+			return viaUpstream(dialViaSOCKS(ctx, route.upstream, hostPort))
+		default:
+			return viaUpstream(dialViaProxy(ctx, route.upstream, hostPort))
+		}
+	}
+	if *respectEnvProxy {
+		proxyURL, err := envProxyURL(hostPort)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			return viaUpstream(dialViaProxy(ctx, proxyURL, hostPort))
+		}
+	}
+	return dialDirect(directCtx, hostPort)
+}
+
+// viaUpstream marks the error of a dial through an upstream proxy.
+func viaUpstream(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		return nil, &upstreamError{err}
+	}
+	return conn, nil
+}
+
+// dialDirect connects to hostPort, retrying transient failures with
+// exponential backoff within the -dial-timeout budget. With -max-upstream it
+// first waits for a free upstream slot, which the returned conn's Close frees.
+func dialDirect(ctx context.Context, hostPort string) (net.Conn, error) {
+	var deadline time.Time
+	if *dialTimeout > 0 {
+		deadline = time.Now().Add(*dialTimeout)
+	}
+	dialer := targetDialer(deadline)
+
+	if upstreamSlots != nil {
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case upstreamSlots <- struct{}{}:
+		case <-timeout:
+			return nil, errUpstreamLimit
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		conn, err := dialWithRetries(ctx, dialer, hostPort, deadline)
+		if err != nil {
+			<-upstreamSlots
+			return nil, err
+		}
+		return &upstreamConn{Conn: conn}, nil
+	}
+	return dialWithRetries(ctx, dialer, hostPort, deadline)
+}
+
+// targetDialer returns the dialer for direct connections, set up from the
+// -source-ip and -happy-eyeballs flags, that gives up at deadline and applies
+// the address policy to each address it tries.
+func targetDialer(deadline time.Time) *net.Dialer {
+	dialer := &net.Dialer{Deadline: deadline, FallbackDelay: *happyEyeballsDelay}
+	if sourceAddr != nil {
+		dialer.LocalAddr = sourceAddr
+	}
+	dialer.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		return checkTargetAddr(ctx, address)
+	}
+	if !*happyEyeballs {
+		dialer.FallbackDelay = -1 // try addresses strictly one after another
+	}
+	return dialer
+}
+
+// dialWithRetries dials hostPort until it succeeds, fails permanently, runs
+// out of retries, would exceed deadline or ctx is canceled.
+func dialWithRetries(ctx context.Context, dialer *net.Dialer, hostPort string, deadline time.Time) (net.Conn, error) {
+	backoff := *dialBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, "tcp", hostPort)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= *dialRetries || !isRetriableDialError(err) {
+			return nil, err
+		}
+		if !deadline.IsZero() && time.Until(deadline) <= backoff {
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// isRetriableDialError reports whether a dial error is likely to go away on
+// its own: timeouts, refused connections and temporary DNS failures.
+func isRetriableDialError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyDialer returns a dialer whose first failures attempts are refused.
+func flakyDialer(failures int32, calls *atomic.Int32) *net.Dialer {
+	return &net.Dialer{
+		ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if calls.Add(1) <= failures {
+				return syscall.ECONNREFUSED
+			}
+			return nil
+		},
+	}
+}
+
+func TestDialWithRetries(t *testing.T) {
+	setFlag(t, "dial-retries", "3")
+	setFlag(t, "dial-backoff", "1ms")
+	echo := startEcho(t)
+
+	var calls atomic.Int32
+	conn, err := dialWithRetries(context.Background(), flakyDialer(2, &calls), echo, time.Time{})
+	if err != nil {
+		t.Fatalf("dial failed after %d attempts: %v", calls.Load(), err)
+	}
+	conn.Close()
+	if calls.Load() != 3 {
+		t.Errorf("%d attempts, want 3", calls.Load())
+	}
+}
+
+func TestDialWithRetriesGivesUp(t *testing.T) {
+	setFlag(t, "dial-retries", "1")
+	setFlag(t, "dial-backoff", "1ms")
+	echo := startEcho(t)
+
+	var calls atomic.Int32
+	_, err := dialWithRetries(context.Background(), flakyDialer(5, &calls), echo, time.Time{})
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("err = %v, want connection refused", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("%d attempts, want 2", calls.Load())
+	}
+}
+
+func TestIsRetriableDialError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNRESET}, true},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, false},
+		{&blockedDialError{rule: "private:loopback"}, false},
+	}
+	for _, tt := range tests {
+		if got := isRetriableDialError(tt.err); got != tt.want {
+			t.Errorf("isRetriableDialError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestMaxUpstream(t *testing.T) {
+	setFlag(t, "dial-timeout", "100ms")
+	upstreamSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { upstreamSlots = nil })
+	echo := startEcho(t)
+
+	first, err := dialDirect(context.Background(), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialDirect(context.Background(), echo); !errors.Is(err, errUpstreamLimit) {
+		t.Errorf("dial over the limit: %v, want errUpstreamLimit", err)
+	}
+	first.Close()
+	first.Close() // a second Close must not free another slot
+	second, err := dialDirect(context.Background(), echo)
+	if err != nil {
+		t.Fatalf("dial after a slot was freed: %v", err)
+	}
+	defer second.Close()
+	if len(upstreamSlots) != 1 {
+		t.Errorf("%d slots taken, want 1", len(upstreamSlots))
+	}
+
+	// the proxy answers a dial that found no slot with 503
+	proxy := startProxy(t, handleClientConnection)
+	if _, _, status := connect(t, proxy, echo); status != http.StatusServiceUnavailable {
+		t.Errorf("CONNECT over the limit: status %d, want 503", status)
+	}
+}
+
+func TestMaxUpstreamFailedDialFreesSlot(t *testing.T) {
+	upstreamSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { upstreamSlots = nil })
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := listener.Addr().String()
+	listener.Close()
+
+	if _, err := dialDirect(context.Background(), closed); err == nil {
+		t.Fatal("dial to a closed port succeeded")
+	}
+	if len(upstreamSlots) != 0 {
+		t.Error("failed dial kept its slot")
+	}
+}
+
+func TestCanceledDialReturnsPromptly(t *testing.T) {
+	setFlag(t, "dial-retries", "5")
+	setFlag(t, "dial-backoff", "10s")
+	echo := startEcho(t)
+
+	// cancel during the retry backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	var calls atomic.Int32
+	start := time.Now()
+	_, err := dialWithRetries(ctx, flakyDialer(5, &calls), echo, time.Time{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("backoff not interrupted, returned after %v", elapsed)
+	}
+
+	// cancel while waiting for an upstream slot
+	setFlag(t, "dial-timeout", "10s")
+	upstreamSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { upstreamSlots = nil })
+	upstreamSlots <- struct{}{}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start = time.Now()
+	if _, err := dialDirect(ctx, echo); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("slot wait not interrupted, returned after %v", elapsed)
+	}
+}
+
+func TestTargetDialerHappyEyeballs(t *testing.T) {
+	setFlag(t, "happy-eyeballs-delay", "50ms")
+	if d := targetDialer(time.Time{}); d.FallbackDelay != 50*time.Millisecond {
+		t.Errorf("FallbackDelay = %v, want 50ms", d.FallbackDelay)
+	}
+
+	// a negative delay disables the race in net.Dialer
+	setFlag(t, "happy-eyeballs", "false")
+	d := targetDialer(time.Time{})
+	if d.FallbackDelay >= 0 {
+		t.Errorf("FallbackDelay = %v, want sequential attempts", d.FallbackDelay)
+	}
+	echo := startEcho(t)
+	conn, err := d.DialContext(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatalf("sequential dial: %v", err)
+	}
+	conn.Close()
+}
+
+func TestParseSourceIP(t *testing.T) {
+	if addr, err := parseSourceIP("127.0.0.1"); err != nil || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port != 0 {
+		t.Errorf("parseSourceIP(127.0.0.1) = %v, %v", addr, err)
+	}
+	if _, err := parseSourceIP("not-an-ip"); err == nil {
+		t.Error("invalid IP accepted")
+	}
+	// TEST-NET-1 is never assigned to a host
+	if _, err := parseSourceIP("192.0.2.99"); err == nil {
+		t.Error("unassigned IP accepted")
+	}
+}
+
+func TestSourceIPDials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 needs linux")
+	}
+	addr, err := parseSourceIP("127.0.0.2")
+	if err != nil {
+		t.Skip(err)
+	}
+	sourceAddr = addr
+	t.Cleanup(func() { sourceAddr = nil })
+
+	conn, err := dialDirect(context.Background(), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(addr.IP) {
+		t.Errorf("dialed from %s, want 127.0.0.2", ip)
+	}
+}
+
+// dualStackResolver resolves every name to 127.0.0.1 and ::1 through an
+// in-process DNS server.
+var dualStackResolver = &net.Resolver{
+	PreferGo: true,
+	Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serveDualStackDNS(server)
+		return client, nil
+	},
+}
+
+// serveDualStackDNS answers length-prefixed (TCP style) DNS queries on conn
+// with the loopback address of the queried family.
+func serveDualStackDNS(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		// the question follows the 12-byte header: a name, type and class
+		end := 12
+		for end < len(query) && query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+		end += 5
+		if end > len(query) {
+			return
+		}
+		qtype := binary.BigEndian.Uint16(query[end-4:])
+
+		resp := append([]byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, query[12:end]...)
+		var rdata []byte
+		switch qtype {
+		case 1: // A
+			rdata = net.IPv4(127, 0, 0, 1).To4()
+		case 28: // AAAA
+			rdata = net.IPv6loopback
+		}
+		if rdata != nil {
+			resp[7] = 1 // one answer
+			resp = append(resp, 0xc0, 12, byte(qtype>>8), byte(qtype), 0, 1, 0, 0, 0, 60, 0, byte(len(rdata)))
+			resp = append(resp, rdata...)
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+		if _, err := conn.Write(append(size[:], resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// TestHappyEyeballsRace dials a dual-stack name whose preferred family never
+// answers: the racing dialer reaches the other family after the fallback
+// delay, the sequential one only once the first attempt gives up.
+func TestHappyEyeballsRace(t *testing.T) {
+	addrs, err := dualStackResolver.LookupIPAddr(context.Background(), "dualstack.test")
+	if err != nil || len(addrs) != 2 {
+		t.Fatalf("fake resolver: %v, %v", addrs, err)
+	}
+	// the first address is tried first; it is made to hang like a
+	// blackholed route, and only the other family listens
+	dead := "tcp4"
+	live := "[::1]:0"
+	if addrs[0].IP.To4() == nil {
+		dead, live = "tcp6", "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", live)
+	if err != nil {
+		t.Skipf("no loopback for the fallback family: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	dial := func(deadline time.Time) (time.Duration, error) {
+		d := targetDialer(deadline)
+		d.Resolver = dualStackResolver
+		d.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if network == dead {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		}
+		start := time.Now()
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("dualstack.test", port))
+		if err == nil {
+			conn.Close()
+		}
+		return time.Since(start), err
+	}
+
+	setFlag(t, "happy-eyeballs-delay", "100ms")
+	elapsed, err := dial(time.Now().Add(2 * time.Second))
+	if err != nil {
+		t.Fatalf("racing dial: %v", err)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("racing dial took %v, want about the 100ms fallback delay", elapsed)
+	}
+
+	// net.Dialer gives each sequential attempt a share of the deadline, but
+	// at least 2s
+	setFlag(t, "happy-eyeballs", "false")
+	elapsed, err = dial(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatalf("sequential dial: %v", err)
+	}
+	if elapsed < 2*time.Second {
+		t.Errorf("sequential dial took %v, want it to wait on the dead address first", elapsed)
+	}
+}
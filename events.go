@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var logNewTargets = flag.Bool("log-new-targets", false, "log the first connection to each target host since startup")
+
+// seenTargets holds the target hosts connected to since startup.
+var seenTargets sync.Map
+
+// The event functions are called by the handlers at each step of a
+// connection's life and fan out to the metrics, StatsD and the optional hooks.
+
+func eventAccept(stats *Stats) {
+	stats.conn = trackConn(stats.ClientIP)
+	recordAccept()
+	if statsd != nil {
+		statsd.count("connections", 1)
+	}
+	if hooks != nil {
+		callHook("OnAccept", func() { hooks.OnAccept(stats.ClientIP) })
+	}
+}
+
+func eventTarget(stats *Stats) {
+	clientIP, target := stats.ClientIP, stats.Target
+	stats.conn.setTarget(target)
+	if *logNewTargets {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			host = target
+		}
+		if _, seen := seenTargets.LoadOrStore(host, true); !seen {
+			log.Printf("[Client %s] New target: %s", clientIP, logHost(target))
+		}
+	}
+	if hooks != nil {
+		callHook("OnTarget", func() { hooks.OnTarget(clientIP, target) })
+	}
+}
+
+func eventBlock(stats *Stats) {
+	recordBlock()
+	if statsd != nil {
+		statsd.count("blocked", 1)
+	}
+	if hooks != nil {
+		callHook("OnBlock", func() { hooks.OnBlock(stats.ClientIP, stats.Target) })
+	}
+}
+
+// eventClose completes stats for a connection started at start and reports it.
+func eventClose(stats *Stats, start time.Time) {
+	stats.Duration = time.Since(start)
+	stats.conn.untrack()
+	recordClose(*stats)
+	writeAccessLog(*stats, start)
+	recordSpan(*stats, start)
+	if statsd != nil {
+		statsd.count("bytes_in", stats.BytesIn)
+		statsd.count("bytes_out", stats.BytesOut)
+		statsd.timing("duration", stats.Duration)
+	}
+	if hooks != nil {
+		callHook("OnClose", func() { hooks.OnClose(*stats) })
+	}
+}
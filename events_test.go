@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogNewTargets(t *testing.T) {
+	setFlag(t, "log-new-targets", "true")
+	t.Cleanup(func() { seenTargets = sync.Map{} })
+	logs := captureLog(t)
+
+	for _, target := range []string{"a.example:443", "a.example:8443", "b.example:443", "a.example:443"} {
+		stats := &Stats{ClientIP: "10.0.0.1", Target: target}
+		eventAccept(stats)
+		eventTarget(stats)
+		eventClose(stats, time.Now())
+	}
+	if n := strings.Count(logs.String(), "New target: a.example"); n != 1 {
+		t.Errorf("a.example logged %d times, want once; log: %s", n, logs)
+	}
+	if !logged(logs, "[Client 10.0.0.1] New target: b.example:443") {
+		t.Errorf("b.example not logged; log: %s", logs)
+	}
+}
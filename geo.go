@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	geoDBPaths     = flag.String("geo-db", "", "comma-separated MaxMind DB files (e.g. GeoLite2-Country.mmdb,GeoLite2-ASN.mmdb) for -block-countries and -block-asns")
+	blockCountries = flag.String("block-countries", "", "comma-separated ISO country codes whose target IPs are blocked, e.g. KP,IR")
+	blockASNs      = flag.String("block-asns", "", "comma-separated autonomous system numbers whose target IPs are blocked")
+	blockPrivate   = flag.Bool("block-private", false, "refuse targets resolving to loopback, private (RFC 1918, fc00::/7), link-local or cloud metadata addresses such as 169.254.169.254; -rewrite replacements are exempt. Recommended for proxies open to untrusted clients")
+)
+
+// blockedDialError is returned by target dials refused by an IP policy.
+type blockedDialError struct {
+	rule string
+}
+
+func (e *blockedDialError) Error() string {
+	return "target address blocked by rule " + e.rule
+}
+
+// geoPolicy blocks target IPs by the country or ASN its databases report.
+type geoPolicy struct {
+	dbs       []*mmdbReader
+	countries map[string]bool
+	asns      map[uint64]bool
+}
+
+// geoBlock is nil unless -geo-db is set together with a block list.
+var geoBlock *geoPolicy
+
+func newGeoPolicy(paths, countries, asns string) (*geoPolicy, error) {
+	p := &geoPolicy{countries: make(map[string]bool), asns: make(map[uint64]bool)}
+	for _, path := range strings.Split(paths, ",") {
+		db, err := openMMDB(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		p.dbs = append(p.dbs, db)
+	}
+	for _, code := range strings.Split(countries, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			p.countries[strings.ToUpper(code)] = true
+		}
+	}
+	for _, asn := range strings.Split(asns, ",") {
+		asn = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(asn)), "AS")
+		if asn == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(asn, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ASN %q", asn)
+		}
+		p.asns[n] = true
+	}
+	return p, nil
+}
+
+// match returns the rule blocking ip, e.g. "country:KP" or "asn:64496".
+func (p *geoPolicy) match(ip net.IP) (string, bool) {
+	for _, db := range p.dbs {
+		record, err := db.lookup(ip)
+		if err != nil || record == nil {
+			continue
+		}
+		fields, _ := record.(map[string]any)
+		for _, key := range []string{"country", "registered_country"} {
+			country, _ := fields[key].(map[string]any)
+			if code, _ := country["iso_code"].(string); p.countries[code] {
+				return "country:" + code, true
+			}
+		}
+		if asn, ok := fields["autonomous_system_number"].(uint64); ok && p.asns[asn] {
+			return "asn:" + strconv.FormatUint(asn, 10), true
+		}
+	}
+	return "", false
+}
+
+// targetDialKey marks a dial context as a direct dial to a tunnel target, as
+// opposed to an upstream proxy, so target IP policies apply to it.
+type targetDialKey struct{}
+
+func withTargetDial(ctx context.Context) context.Context {
+	return context.WithValue(ctx, targetDialKey{}, true)
+}
+
+// checkTargetAddr is the dialer's ControlContext. It refuses target dials to
+// IPs blocked by -block-private, -block-countries or -block-asns. It runs
+// after DNS resolution for every address tried, so a host name that resolves
+// to a private address is caught too, including on DNS rebinding.
+func checkTargetAddr(ctx context.Context, address string) error {
+	if ctx.Value(targetDialKey{}) == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	if *blockPrivate {
+		if rule, blocked := privateAddrRule(ip); blocked {
+			return &blockedDialError{rule: rule}
+		}
+	}
+	if geoBlock != nil {
+		if rule, blocked := geoBlock.match(ip); blocked {
+			return &blockedDialError{rule: rule}
+		}
+	}
+	return nil
+}
+
+// privateAddrRule reports whether ip is an address -block-private refuses,
+// naming its kind.
+func privateAddrRule(ip net.IP) (string, bool) {
+	switch {
+	case ip.IsLoopback():
+		return "private:loopback", true
+	case ip.IsPrivate():
+		return "private:rfc1918", true
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		// includes the 169.254.169.254 cloud metadata service
+		return "private:link-local", true
+	case ip.IsUnspecified():
+		return "private:unspecified", true
+	case cgnat.Contains(ip):
+		return "private:shared", true
+	}
+	return "", false
+}
+
+// cgnat is the shared address space of RFC 6598, used inside carrier and
+// cloud networks.
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
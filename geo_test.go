@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// MaxMind DB encoders for the few types the fixture needs.
+func mmdbString(s string) []byte { return append([]byte{2<<5 | byte(len(s))}, s...) }
+
+func mmdbMap(pairs ...[]byte) []byte {
+	out := []byte{7<<5 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// mmdbUintN encodes v in size bytes as a uint16 (typ 5) or uint32 (typ 6).
+func mmdbUintN(typ byte, v uint32, size int) []byte {
+	out := []byte{typ<<5 | byte(size)}
+	for i := size - 1; i >= 0; i-- {
+		out = append(out, byte(v>>(8*i)))
+	}
+	return out
+}
+
+// writeGeoDB writes an IPv4 database mapping 127.0.0.0/8 to country KP and
+// AS64496; every other address has no record.
+func writeGeoDB(t *testing.T) string {
+	t.Helper()
+	const nodes = 8
+	var tree []byte
+	for i := 0; i < nodes; i++ {
+		next := uint32(i + 1)
+		if i == nodes-1 {
+			next = nodes + 16 // the first data record
+		}
+		left, right := next, uint32(nodes)
+		if 0x7f>>(7-i)&1 == 1 {
+			left, right = uint32(nodes), next
+		}
+		tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+	}
+	data := mmdbMap(
+		mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("KP")),
+		mmdbString("autonomous_system_number"), mmdbUintN(6, 64496, 2),
+	)
+	meta := mmdbMap(
+		mmdbString("node_count"), mmdbUintN(6, nodes, 1),
+		mmdbString("record_size"), mmdbUintN(5, 24, 1),
+		mmdbString("ip_version"), mmdbUintN(5, 4, 1),
+	)
+
+	db := append(tree, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, meta...)
+	path := filepath.Join(t.TempDir(), "geo.mmdb")
+	if err := os.WriteFile(path, db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoPolicy(t *testing.T) {
+	path := writeGeoDB(t)
+	tests := []struct {
+		countries, asns string
+		ip              string
+		want            string
+	}{
+		{"kp", "", "127.0.0.1", "country:KP"},
+		{"", "AS64496", "127.0.0.1", "asn:64496"},
+		{"IR", "64497", "127.0.0.1", ""},
+		{"KP", "64496", "10.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		p, err := newGeoPolicy(path, tt.countries, tt.asns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rule, blocked := p.match(net.ParseIP(tt.ip))
+		if rule != tt.want || blocked != (tt.want != "") {
+			t.Errorf("countries=%q asns=%q: match(%s) = %q, %v, want %q", tt.countries, tt.asns, tt.ip, rule, blocked, tt.want)
+		}
+	}
+
+	if _, err := newGeoPolicy(path, "", "AS12x"); err == nil {
+		t.Error("invalid ASN accepted")
+	}
+	if _, err := newGeoPolicy(filepath.Join(t.TempDir(), "missing.mmdb"), "KP", ""); err == nil {
+		t.Error("missing database accepted")
+	}
+}
+
+func TestCheckTargetAddrGeo(t *testing.T) {
+	p, err := newGeoPolicy(writeGeoDB(t), "KP", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoBlock = p
+	t.Cleanup(func() { geoBlock = nil })
+
+	target := withTargetDial(context.Background())
+	var blocked *blockedDialError
+	if err := checkTargetAddr(target, "127.0.0.1:443"); !errors.As(err, &blocked) || blocked.rule != "country:KP" {
+		t.Errorf("target dial to 127.0.0.1: %v, want blocked by country:KP", err)
+	}
+	if err := checkTargetAddr(context.Background(), "127.0.0.1:443"); err != nil {
+		t.Errorf("upstream dial checked against the target policy: %v", err)
+	}
+}
+
+func TestPrivateAddrRule(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"127.0.0.1", "private:loopback"},
+		{"::1", "private:loopback"},
+		{"10.0.0.1", "private:rfc1918"},
+		{"192.168.1.1", "private:rfc1918"},
+		{"fd00::1", "private:rfc1918"},
+		{"169.254.169.254", "private:link-local"},
+		{"fe80::1", "private:link-local"},
+		{"0.0.0.0", "private:unspecified"},
+		{"100.64.0.1", "private:shared"},
+		{"100.127.255.254", "private:shared"},
+		{"100.128.0.1", ""},
+		{"93.184.216.34", ""},
+		{"2606:4700::1111", ""},
+	}
+	for _, tt := range tests {
+		rule, blocked := privateAddrRule(net.ParseIP(tt.ip))
+		if rule != tt.want || blocked != (tt.want != "") {
+			t.Errorf("privateAddrRule(%s) = %q, %v, want %q", tt.ip, rule, blocked, tt.want)
+		}
+	}
+}
+
+func TestBlockPrivateConnect(t *testing.T) {
+	setFlag(t, "block-private", "true")
+	echo := startEcho(t)
+	proxy := startProxy(t, handleClientConnection)
+	if _, _, status := connect(t, proxy, echo); status != http.StatusTeapot {
+		t.Errorf("CONNECT to loopback with -block-private: status %d, want 418", status)
+	}
+
+	setFlag(t, "block-private", "false")
+	if _, _, status := connect(t, proxy, echo); status != http.StatusOK {
+		t.Errorf("CONNECT to loopback without -block-private: status %d, want 200", status)
+	}
+}
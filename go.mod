@@ -2,4 +2,4 @@ module go-minimal-proxy
 
 go 1.22.5
 
-require golang.org/x/net v0.28.0 // indirect
+require gopkg.in/yaml.v3 v3.0.1
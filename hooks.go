@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Stats describes a finished client connection.
+type Stats struct {
+	ClientIP string
+	Target   string
+	BytesIn  int64 // bytes read from the client
+	BytesOut int64 // bytes written to the client
+	Status   int   // HTTP status sent to the client, 0 if none
+	Duration time.Duration
+
+	request   string // request line, or the target of a transparent connection
+	userAgent string
+	conn      *trackedConn
+}
+
+// ConnHooks receives connection lifecycle events, e.g. for accounting. It is
+// an internal extension point: package main can't be imported, so a hook is
+// wired up by setting hooks in this tree, before the proxy starts accepting
+// connections; nil disables them. A panicking hook is logged and ignored.
+type ConnHooks interface {
+	OnAccept(clientIP string)
+	OnTarget(clientIP, target string)
+	OnBlock(clientIP, target string)
+	OnClose(stats Stats)
+}
+
+var hooks ConnHooks
+
+// callHook runs a hook call, logging a panic in it instead of letting it
+// take down the connection.
+func callHook(event string, call func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in %s hook: %v\n%s", event, r, debug.Stack())
+		}
+	}()
+	call()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recordingHooks records the events it receives.
+type recordingHooks struct {
+	mu     sync.Mutex
+	events []string
+	closed Stats
+}
+
+func (h *recordingHooks) record(event string) {
+	h.mu.Lock()
+	h.events = append(h.events, event)
+	h.mu.Unlock()
+}
+
+func (h *recordingHooks) OnAccept(clientIP string)         { h.record("accept " + clientIP) }
+func (h *recordingHooks) OnTarget(clientIP, target string) { h.record("target " + target) }
+func (h *recordingHooks) OnBlock(clientIP, target string)  { h.record("block " + target) }
+func (h *recordingHooks) OnClose(stats Stats) {
+	h.record("close")
+	h.mu.Lock()
+	h.closed = stats
+	h.mu.Unlock()
+}
+
+func TestHooksBlockedConnect(t *testing.T) {
+	rec := &recordingHooks{}
+	hooks = rec
+	t.Cleanup(func() { hooks = nil })
+	list := map[string]*schedule{"blocked.example": nil}
+	blacklist.Store(&list)
+	defer blacklist.Store(nil)
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleClientConnection(server)
+		close(done)
+	}()
+	io.WriteString(client, "CONNECT blocked.example:443 HTTP/1.1\r\nHost: blocked.example:443\r\n\r\n")
+	resp, _ := io.ReadAll(client)
+	<-done
+
+	want := []string{"accept pipe", "target blocked.example:443", "block blocked.example:443", "close"}
+	if !reflect.DeepEqual(rec.events, want) {
+		t.Errorf("events = %q, want %q", rec.events, want)
+	}
+	if rec.closed.Status != 418 || rec.closed.Target != "blocked.example:443" {
+		t.Errorf("OnClose stats = %+v, want status 418 for blocked.example:443", rec.closed)
+	}
+	if got := string(resp); got != "HTTP/1.1 418 I'm a teapot\r\n\r\n" {
+		t.Errorf("response = %q", got)
+	}
+}
+
+type panickingHooks struct{}
+
+func (panickingHooks) OnAccept(string)         { panic("accept") }
+func (panickingHooks) OnTarget(string, string) { panic("target") }
+func (panickingHooks) OnBlock(string, string)  { panic("block") }
+func (panickingHooks) OnClose(Stats)           { panic("close") }
+
+func TestPanickingHooksDoNotCrash(t *testing.T) {
+	hooks = panickingHooks{}
+	t.Cleanup(func() { hooks = nil })
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleClientConnection(server)
+		close(done)
+	}()
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, _ := io.ReadAll(client)
+	<-done
+	if got := string(resp); got != "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\n\r\n" {
+		t.Errorf("response = %q", got)
+	}
+}
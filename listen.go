@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	listenAddr    = flag.String("listen", "", `address to listen on, or "unix:/path/to.sock" for a unix socket (default ":10000", or ":$PORT" if PORT is set)`)
+	socketMode    = flag.String("socket-mode", "", "file mode for a unix listening socket, e.g. 0660")
+	listenNetwork = flag.String("listen-network", "tcp", "network for TCP listeners: tcp for dual-stack, tcp4 for IPv4 only or tcp6 for IPv6 only")
+)
+
+// defaultListenAddr is used when neither -listen nor PORT is set.
+const defaultListenAddr = ":10000"
+
+// listen opens the proxy listener for addr, binding TCP addresses on
+// -listen-network.
+func listen(addr string) (net.Listener, error) {
+	return listenOn(*listenNetwork, addr)
+}
+
+// listenOn opens a listener for addr, binding TCP addresses on network; IPv6
+// hosts are bracketed, e.g. "[::1]:8080". Unix socket addresses are prefixed
+// with "unix:"; a stale socket file left by a previous run is removed first.
+// The socket file itself is removed again when the listener is closed. The
+// admin and pprof listeners use plain "tcp", since -listen-network is about
+// the proxy's own listener.
+func listenOn(network, addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		if err := checkListenAddr(network, addr); err != nil {
+			return nil, err
+		}
+		return net.Listen(network, addr)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if *socketMode != "" {
+		mode, err := strconv.ParseUint(*socketMode, 8, 32)
+		if err == nil {
+			err = os.Chmod(path, fs.FileMode(mode))
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("set socket mode %q: %w", *socketMode, err)
+		}
+	}
+	return listener, nil
+}
+
+// checkListenAddr reports an error if addr is not a valid host:port for
+// network, e.g. an IPv6 address on tcp4.
+func checkListenAddr(network, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	switch network {
+	case "tcp":
+	case "tcp4":
+		if ip != nil && ip.To4() == nil {
+			return fmt.Errorf("%s is not an IPv4 address", host)
+		}
+	case "tcp6":
+		if ip != nil && ip.To4() != nil {
+			return fmt.Errorf("%s is not an IPv6 address", host)
+		}
+	default:
+		return fmt.Errorf("unknown listen network %q, want tcp, tcp4 or tcp6", network)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socketPath returns a path for a unix socket that is short enough for the
+// platform's sun_path limit.
+func socketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "proxy.sock")
+}
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket file modes are not supported on windows")
+	}
+	path := socketPath(t)
+	setFlag(t, "socket-mode", "0600")
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("socket mode %o, want 600", mode)
+	}
+
+	go serve(listener, handleClientConnection)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT 127.0.0.1 HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	resp, _ := io.ReadAll(conn)
+	conn.Close()
+	if !strings.HasPrefix(string(resp), "HTTP/1.1 ") {
+		t.Errorf("no HTTP response over the socket: %q", resp)
+	}
+
+	listener.Close()
+	handlers.Wait()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind: %v", err)
+	}
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := socketPath(t)
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	// keep the file, as a crashed process would
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	listener.Close()
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	path := socketPath(t)
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix:" + path); err == nil {
+		t.Error("listen replaced a regular file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Error("regular file was modified")
+	}
+}
+
+func TestCheckListenAddr(t *testing.T) {
+	tests := []struct {
+		network, addr string
+		ok            bool
+	}{
+		{"tcp", ":10000", true},
+		{"tcp", "[::1]:10000", true},
+		{"tcp4", "127.0.0.1:10000", true},
+		{"tcp4", "[::1]:10000", false},
+		{"tcp4", "localhost:10000", true},
+		{"tcp6", "[::1]:10000", true},
+		{"tcp6", "127.0.0.1:10000", false},
+		{"udp", ":10000", false},
+		{"tcp", "10000", false},
+	}
+	for _, tt := range tests {
+		if err := checkListenAddr(tt.network, tt.addr); (err == nil) != tt.ok {
+			t.Errorf("checkListenAddr(%s, %s) = %v", tt.network, tt.addr, err)
+		}
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	setFlag(t, "listen-network", "tcp4")
+	listener, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	if _, err := listen("[::1]:0"); err == nil {
+		t.Error("tcp4 listener bound to an IPv6 address")
+	}
+
+	setFlag(t, "listen-network", "tcp6")
+	listener, err = listen("[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer listener.Close()
+	if ip := listener.Addr().(*net.TCPAddr).IP; ip.To4() != nil {
+		t.Errorf("tcp6 listener on %s", ip)
+	}
+}
+
+func TestListenNetworkOnlyForProxy(t *testing.T) {
+	setFlag(t, "listen-network", "tcp6")
+	if err := startAdmin("127.0.0.1:0"); err != nil {
+		t.Errorf("admin API on 127.0.0.1 with -listen-network tcp6: %v", err)
+	}
+	if err := startPprof("127.0.0.1:0"); err != nil {
+		t.Errorf("pprof on 127.0.0.1 with -listen-network tcp6: %v", err)
+	}
+}
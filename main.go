@@ -2,16 +2,100 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go-minimal-proxy/tunnel"
+)
+
+// tlsPeekTimeout bounds how long a tunnel waits for the client's first bytes
+// when they are inspected.
+const tlsPeekTimeout = 10 * time.Second
+
+// handlers tracks the running connection handlers.
+var handlers sync.WaitGroup
+
+// serverCtx is canceled when the proxy shuts down, aborting pending dials.
+var serverCtx, stopServer = context.WithCancel(context.Background())
+
+// tunnelCtx is canceled when -shutdown-timeout runs out, closing the tunnels
+// still open. Tunnels are left to finish on their own until then.
+var tunnelCtx, stopTunnels = context.WithCancel(context.Background())
+
+// command-line flags
+var (
+	configPath         = flag.String("config", "", "load flag values from a YAML file; command-line flags take precedence")
+	transparent        = flag.Bool("transparent", false, "tunnel to the original destination of redirected connections instead of reading a CONNECT (linux only)")
+	maxTunnels         = flag.Int("max-tunnels", 0, "maximum number of simultaneous tunnels, 0 for unlimited")
+	acceptQueue        = flag.Int("accept-queue", 0, "number of connections that may wait for a -max-tunnels slot, 0 to reject immediately")
+	acceptQueueTimeout = flag.Duration("accept-queue-timeout", 5*time.Second, "how long a queued connection waits for a tunnel slot before it is rejected")
+	redactURLs         = flag.Bool("redact-urls", false, "log only the scheme and host of request URLs")
+	logPathOnly        = flag.Bool("log-path-only", false, "log request URLs without their query string")
+	requirePort        = flag.Bool("require-port", false, "reject CONNECT targets without a port with 400 instead of defaulting to 443")
+	maxBytes           = flag.Int64("max-bytes", 0, "maximum bytes a connection may transfer in either direction, 0 for unlimited")
+	acceptBackoffMax   = flag.Duration("accept-backoff-max", time.Second, "maximum delay between retries after temporary accept errors")
+	logMTLS            = flag.Bool("log-mtls", false, "log tunnels whose server requests a TLS client certificate (visible up to TLS 1.2 only)")
+	logTLSParams       = flag.Bool("log-tls", false, "log the TLS version and cipher suite each tunnel's server selects")
+	checkHost          = flag.String("check", "", "print whether host[:port] would be blocked by the blacklist, -rules, -connect-ports or the address policy and exit (status 1 if blocked)")
+	maxHeaderCount     = flag.Int("max-header-count", 0, "reject requests with more header lines than this with 431, 0 for unlimited")
+	blacklistPath      = flag.String("blacklist", "blacklist.txt", `blacklist file or http(s):// URL; a missing file allows all hosts, "" disables the blacklist`)
+	emptyBlacklist     = flag.String("empty-blacklist", "allow", `what an empty or missing -blacklist does: "allow" all hosts or "deny" all hosts`)
+	checkTLSPort       = flag.Bool("check-tls-443", false, "reject CONNECT tunnels to port 443 whose client does not start a TLS handshake")
+	checkSNI           = flag.Bool("check-sni", false, "match the server name in the client's TLS ClientHello against the blacklist too")
+	checkSNIPorts      = flag.String("check-sni-ports", "443", "comma-separated target ports -check-sni inspects; tunnels to other ports, where the server may speak first, are not delayed")
+	shutdownTimeout    = flag.Duration("shutdown-timeout", 5*time.Second, "how long to wait for open connections to finish on shutdown")
+	headerTimeout      = flag.Duration("header-timeout", 30*time.Second, "time a client has to send its complete request header, 0 for no limit")
+	maxHeaderBytes     = flag.Int64("max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of a request header in bytes, 0 for unlimited")
+	idleTimeout        = flag.Duration("idle-timeout", 0, "close tunnels without traffic in either direction for this long, 0 to disable")
+	maxConnDuration    = flag.Duration("max-conn-duration", 0, "close tunnels that have been open this long, even while data is flowing; 0 for no limit")
+	quiet              = flag.Bool("quiet", false, "log no per-connection lines except errors")
+	connectPorts       = flag.String("connect-ports", "", "comma-separated ports CONNECT may tunnel to, e.g. 443,8443; others get 403 (default all ports)")
+	infoPage           = flag.Bool("info-page", false, "answer GET / with a short page saying this is a CONNECT proxy instead of 405")
 )
 
+// allowedPorts holds the ports from -connect-ports; nil allows all.
+var allowedPorts map[string]bool
+
+// sniPorts holds the ports from -check-sni-ports.
+var sniPorts map[string]bool
+
+// parsePorts parses a comma-separated list of port numbers.
+func parsePorts(list string) (map[string]bool, error) {
+	ports := make(map[string]bool)
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if n, err := strconv.ParseUint(p, 10, 16); err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ports[p] = true
+	}
+	return ports, nil
+}
+
+// errHeaderTooLarge is returned by headerReader once the request header
+// exceeds -max-header-bytes.
+var errHeaderTooLarge = errors.New("request header too large")
+
 // countingConn wraps a net.Conn and counts the number of bytes written and read.
 type countingConn struct {
 	net.Conn
@@ -33,36 +117,363 @@ func (c *countingConn) Read(b []byte) (int, error) {
 	return n, err
 }
 
-var blacklist map[string]bool
+// NetConn returns the wrapped connection.
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// closeOnceConn makes Close idempotent, so both copy directions and the
+// handler's deferred cleanup may close a connection in any order.
+type closeOnceConn struct {
+	net.Conn
+	once sync.Once
+	err  error
+}
+
+// Close closes the underlying net.Conn on the first call and returns the
+// same result on every call.
+func (c *closeOnceConn) Close() error {
+	c.once.Do(func() {
+		c.err = c.Conn.Close()
+	})
+	return c.err
+}
+
+// NetConn returns the wrapped connection.
+func (c *closeOnceConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader
+// first, so bytes read ahead while parsing aren't lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads from the buffer before the underlying net.Conn.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// NetConn returns the wrapped connection.
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// headerReader limits how many bytes can be read while parsing a request
+// header. A negative remaining lifts the limit once the header is read.
+type headerReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (h *headerReader) Read(b []byte) (int, error) {
+	if h.remaining < 0 {
+		return h.r.Read(b)
+	}
+	if h.remaining == 0 {
+		return 0, errHeaderTooLarge
+	}
+	if int64(len(b)) > h.remaining {
+		b = b[:h.remaining]
+	}
+	n, err := h.r.Read(b)
+	h.remaining -= int64(n)
+	return n, err
+}
+
+// unwrapConn strips wrappers such as closeOnceConn and tls.Conn that expose
+// the connection beneath them through NetConn.
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// blacklist maps the current blacklist entries to their schedules, nil for
+// entries that always apply. A stored map is never modified; updates swap in
+// a changed copy so handlers can read without locks.
+var blacklist atomic.Pointer[map[string]*schedule]
+
+// blacklistUpdates serializes copy-on-write updates of blacklist and guards
+// adminEdits.
+var blacklistUpdates sync.Mutex
+
+// adminEdits holds the entries added (true) or removed (false) through the
+// admin API. They are reapplied to every loaded list, so a refresh of a
+// -blacklist URL doesn't undo them.
+var adminEdits = make(map[string]bool)
 
+func currentBlacklist() map[string]*schedule {
+	if list := blacklist.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// storeBlacklist swaps in a newly loaded list with the admin edits applied.
+func storeBlacklist(list map[string]*schedule) {
+	blacklistUpdates.Lock()
+	defer blacklistUpdates.Unlock()
+	for entry, add := range adminEdits {
+		if add {
+			list[entry] = nil
+		} else {
+			delete(list, entry)
+		}
+	}
+	blacklist.Store(&list)
+}
+
+// editBlacklist adds or removes entry as an admin edit and reports whether it
+// was in the blacklist before.
+func editBlacklist(entry string, add bool) bool {
+	blacklistUpdates.Lock()
+	defer blacklistUpdates.Unlock()
+
+	list := make(map[string]*schedule)
+	for e, sched := range currentBlacklist() {
+		list[e] = sched
+	}
+	_, found := list[entry]
+	if add {
+		list[entry] = nil
+	} else {
+		delete(list, entry)
+	}
+	adminEdits[entry] = add
+	blacklist.Store(&list)
+	return found
+}
+
+// tunnelSlots limits the number of simultaneous tunnels; nil means unlimited.
+var tunnelSlots chan struct{}
+
+// tunnelWaiters counts the connections queued for a tunnel slot.
+var tunnelWaiters atomic.Int64
+
+// acquireTunnel reserves a tunnel slot. When all slots are in use it waits up
+// to -accept-queue-timeout if fewer than -accept-queue connections are already
+// waiting. It reports false if no slot was reserved.
+func acquireTunnel() bool {
+	if tunnelSlots == nil {
+		return true
+	}
+	select {
+	case tunnelSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if tunnelWaiters.Add(1) > int64(*acceptQueue) {
+		tunnelWaiters.Add(-1)
+		return false
+	}
+	defer tunnelWaiters.Add(-1)
+	timer := time.NewTimer(*acceptQueueTimeout)
+	defer timer.Stop()
+	select {
+	case tunnelSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-serverCtx.Done():
+		return false
+	}
+}
+
+func releaseTunnel() {
+	if tunnelSlots != nil {
+		<-tunnelSlots
+	}
+}
+
+// loadBlacklist loads blacklist entries from filename, or fetches them if it
+// is an http(s):// URL. Everything after a '#' is a comment, blank lines are
+// ignored, and in files "include other.txt" loads another list, relative to
+// the including file. An entry may end in a schedule such as
+// "@mon-fri 09:00-17:00" to block only inside that window.
 func loadBlacklist(filename string) error {
-	file, err := os.Open(filename)
+	if isBlacklistURL(filename) {
+		return fetchBlacklist(filename)
+	}
+	list := make(map[string]*schedule)
+	if err := readBlacklistFile(filename, list, make(map[string]bool)); err != nil {
+		return err
+	}
+	storeBlacklist(list)
+	return nil
+}
+
+// readBlacklistFile adds the entries of filename and its includes to list.
+// including holds the files currently being read, to detect include loops.
+func readBlacklistFile(filename string, list map[string]*schedule, including map[string]bool) error {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if including[path] {
+		return fmt.Errorf("include loop at %s", filename)
+	}
+	including[path] = true
+	defer delete(including, path)
+
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	blacklist = make(map[string]bool)
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		blacklist[strings.TrimSpace(scanner.Text())] = true
+	entries, includes, err := parseBlacklist(file, filename, true)
+	if err != nil {
+		return err
 	}
+	for entry, sched := range entries {
+		list[entry] = sched
+	}
+	for _, name := range includes {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(path), name)
+		}
+		if err := readBlacklistFile(name, list, including); err != nil {
+			// not %w: a missing include must not look like a missing list
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return nil
+}
 
-	return scanner.Err()
+// parseBlacklist parses a blacklist read from r, named name in errors. It
+// returns the entries and, if allowInclude is set, the files named by
+// "include" lines; otherwise an include is an error.
+func parseBlacklist(r io.Reader, name string, allowInclude bool) (map[string]*schedule, []string, error) {
+	list := make(map[string]*schedule)
+	var includes []string
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue // an empty prefix would match every host
+		}
+		if include, ok := strings.CutPrefix(line, "include "); ok {
+			if !allowInclude {
+				return nil, nil, fmt.Errorf("%s:%d: include is not supported here", name, lineNo)
+			}
+			includes = append(includes, strings.TrimSpace(include))
+			continue
+		}
+		entry, sched, err := parseBlacklistLine(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", name, lineNo, err)
+		}
+		if entry == "" {
+			continue
+		}
+		list[entry] = sched
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return list, includes, nil
+}
+
+// emptyBlacklistRule is the rule reported for hosts blocked because the
+// blacklist is empty and -empty-blacklist is deny.
+const emptyBlacklistRule = "empty-blacklist"
+
+// loadStartupBlacklist loads the blacklist at startup. A missing file is not
+// an error; it and an empty list only log a warning, since every host is then
+// allowed, or blocked with -empty-blacklist deny.
+func loadStartupBlacklist(path string) error {
+	outcome := "allowed"
+	if *emptyBlacklist == "deny" {
+		outcome = "blocked"
+	}
+	err := loadBlacklist(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		log.Printf("Warning: blacklist %s not found, all hosts are %s", path, outcome)
+	case err != nil:
+		return err
+	case len(currentBlacklist()) == 0:
+		log.Printf("Warning: blacklist is empty, all hosts are %s", outcome)
+	}
+	return nil
 }
 
 func isBlocked(host string) bool {
-	for blockedURL := range blacklist {
-		if strings.HasPrefix(host, blockedURL) {
-			return true
+	_, blocked := matchBlacklist(host)
+	return blocked
+}
+
+// matchBlacklist returns the longest blacklist entry matching host whose
+// schedule is active now. With -empty-blacklist deny, an empty blacklist
+// matches every host.
+func matchBlacklist(host string) (string, bool) {
+	list := currentBlacklist()
+	if len(list) == 0 && *emptyBlacklist == "deny" && *blacklistPath != "" {
+		return emptyBlacklistRule, true
+	}
+	var rule string
+	now := time.Now()
+	for blockedURL, sched := range list {
+		if strings.HasPrefix(host, blockedURL) && len(blockedURL) > len(rule) && sched.active(now) {
+			rule = blockedURL
 		}
 	}
-	return false
+	return rule, rule != ""
+}
+
+// checkIntervals reports the first of the duration flags that drive a
+// time.Tick loop that is not positive; time.Tick returns nil for those, so the
+// loop would silently never run.
+func checkIntervals() error {
+	for _, f := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"influx-interval", *influxInterval},
+		{"otel-interval", *otelInterval},
+		{"breaker-window", *breakerWindow},
+	} {
+		if f.value <= 0 {
+			return fmt.Errorf("-%s %v, want a positive duration", f.name, f.value)
+		}
+	}
+	return nil
+}
+
+// connLogf logs a per-connection line unless -quiet is set.
+func connLogf(format string, args ...any) {
+	if *quiet {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// clientIP returns the IP of a client address without its port, unmapping
+// IPv4-mapped IPv6 addresses. It keys the per-IP limits and is the ClientIP
+// of the logs, so every connection from one host must map to the same value.
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
 }
 
 func extractIPv4FromRemoteAddr(remoteAddr string) string {
 	host, _, err := net.SplitHostPort(remoteAddr)
-	log.Printf("remoteAddr: %s, host: %s", remoteAddr, host)
+	connLogf("remoteAddr: %s, host: %s", remoteAddr, host)
 	if err != nil {
 		return remoteAddr // if error, return original remoteAddr
 	}
@@ -85,93 +496,797 @@ func extractIPv4FromRemoteAddr(remoteAddr string) string {
 	return remoteAddr
 }
 
-func handleClientConnection(client net.Conn) {
+// logURL renders a request URL for logging, honoring -redact-urls and
+// -log-path-only so tokens in paths or queries don't end up in the logs.
+func logURL(u *url.URL) string {
+	switch {
+	case *redactURLs:
+		// appended, since url.URL would escape the brackets
+		return (&url.URL{Scheme: u.Scheme, Host: logHost(u.Host)}).String() + "/[redacted]"
+	case *logPathOnly:
+		return (&url.URL{Scheme: u.Scheme, Host: logHost(u.Host), Path: u.Path}).String()
+	default:
+		masked := *u
+		masked.Host = logHost(u.Host)
+		return masked.String()
+	}
+}
+
+// respond writes a bodiless HTTP response with status to the client and
+// records the status in stats.
+func respond(client net.Conn, stats *Stats, status int) {
+	fmt.Fprintf(client, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+	stats.Status = status
+}
+
+// respondConnectOnly answers a request that isn't CONNECT with 405 and an
+// Allow header, so clients probing the port learn what it serves.
+func respondConnectOnly(client net.Conn, stats *Stats) {
+	status := http.StatusMethodNotAllowed
+	fmt.Fprintf(client, "HTTP/1.1 %d %s\r\nAllow: CONNECT\r\n\r\n", status, http.StatusText(status))
+	stats.Status = status
+}
+
+// serveInfoPage writes a short plain-text page describing the proxy.
+func serveInfoPage(client net.Conn) {
+	page := versionString() + "\n\nThis is a CONNECT proxy. Configure it as the HTTPS proxy of your client;\nplain HTTP requests are not forwarded.\n"
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "Allow": {"CONNECT"}},
+		ContentLength: int64(len(page)),
+		Body:          io.NopCloser(strings.NewReader(page)),
+		Close:         true,
+	}
+	resp.Write(client)
+}
+
+// looksLikeTLS peeks at the first bytes the client sends through the tunnel
+// and reports whether they start a TLS handshake record. Nothing is consumed.
+func looksLikeTLS(client net.Conn, reader *bufio.Reader) bool {
+	client.SetReadDeadline(time.Now().Add(tlsPeekTimeout))
+	defer client.SetReadDeadline(time.Time{})
+
+	// content type handshake(22), then major version 3
+	header, err := reader.Peek(2)
+	return err == nil && header[0] == recordTypeHandshake && header[1] == 3
+}
+
+// peekSNI peeks at the first TLS record the client sends through the tunnel
+// and returns the server name from its ClientHello, or "" if the client does
+// not start with a ClientHello carrying one. Nothing is consumed. Only a
+// ClientHello that fits in the first record is inspected.
+func peekSNI(client net.Conn, reader *bufio.Reader) string {
+	client.SetReadDeadline(time.Now().Add(tlsPeekTimeout))
+	defer client.SetReadDeadline(time.Time{})
+
+	// type(1) version(2) length(2)
+	header, err := reader.Peek(5)
+	if err != nil || header[0] != recordTypeHandshake || header[1] != 3 {
+		return ""
+	}
+	record, err := reader.Peek(5 + int(binary.BigEndian.Uint16(header[3:5])))
+	if err != nil {
+		return ""
+	}
+	// type(1) length(3)
+	msg := record[5:]
+	if len(msg) < 4 || msg[0] != handshakeTypeClientHello {
+		return ""
+	}
+	msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+msgLen {
+		return ""
+	}
+	return parseSNI(msg[4 : 4+msgLen])
+}
+
+// headerCount returns the number of header lines in h.
+func headerCount(h http.Header) int {
+	count := 0
+	for _, values := range h {
+		count += len(values)
+	}
+	return count
+}
+
+// withDefaultPort returns hostPort unchanged when it already carries a port,
+// otherwise joins it with port. Bracketed and bare IPv6 literals are handled.
+func withDefaultPort(hostPort, port string) string {
+	if _, _, err := net.SplitHostPort(hostPort); err == nil {
+		return hostPort
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(hostPort, "["), "]")
+	return net.JoinHostPort(host, port)
+}
+
+func handleClientConnection(conn net.Conn) {
+	client := &closeOnceConn{Conn: conn}
 	defer client.Close()
+	// connID tags every log line of this connection; until the connection
+	// is registered, a panic is reported with the client address
+	connID := conn.RemoteAddr().String()
+	defer recoverHandler(&connID)
 	// extract IPv4 from remoteAddr
 	remoteAddr := extractIPv4FromRemoteAddr(client.RemoteAddr().String())
-	log.Printf("[Client %s] Received connection", remoteAddr)
+	ip := clientIP(client.RemoteAddr().String())
+	stats := Stats{ClientIP: ip}
+	start := time.Now()
+	defer eventClose(&stats, start)
+	eventAccept(&stats)
+	connID = fmt.Sprintf("%s conn=%d", remoteAddr, stats.conn.id)
+	connLogf("[Client %s] Received connection", connID)
+	defer connLogf("[Client %s] Connection closed", connID)
+
+	if clientLimiter != nil {
+		if !clientLimiter.acquire(ip) {
+			connLogf("[Client %s] Too many connections from client, rejecting", connID)
+			respond(client, &stats, http.StatusTooManyRequests)
+			return
+		}
+		defer clientLimiter.release(ip)
+	}
 
 	// read request
-	clientReader := bufio.NewReader(client)
+	header := &headerReader{r: client, remaining: -1}
+	if *maxHeaderBytes > 0 {
+		header.remaining = *maxHeaderBytes
+	}
+	clientReader := bufio.NewReader(header)
+	if *checkSNI {
+		// large enough to peek a whole ClientHello record
+		clientReader = bufio.NewReaderSize(header, maxTLSRecord)
+	}
+	if *headerTimeout > 0 {
+		client.SetReadDeadline(time.Now().Add(*headerTimeout))
+	}
 	req, err := http.ReadRequest(clientReader)
+	client.SetReadDeadline(time.Time{})
+	header.remaining = -1
 	if err != nil {
-		log.Printf("[Client %s] Error reading request: %v", remoteAddr, err)
+		log.Printf("[Client %s] Error reading request: %v", connID, err)
+		var netErr net.Error
+		switch {
+		case errors.Is(err, errHeaderTooLarge):
+			respond(client, &stats, http.StatusRequestHeaderFieldsTooLarge)
+		case errors.As(err, &netErr) && netErr.Timeout():
+			respond(client, &stats, http.StatusRequestTimeout)
+		case !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF):
+			respond(client, &stats, http.StatusBadRequest)
+		}
+		return
+	}
+	target := logURL(req.URL)
+	if req.Method == "CONNECT" {
+		target = logHost(req.RequestURI)
+	}
+	stats.request = req.Method + " " + target + " " + req.Proto
+	stats.userAgent = req.UserAgent()
+
+	if *maxHeaderCount > 0 && headerCount(req.Header) > *maxHeaderCount {
+		connLogf("[Client %s] Rejecting request with more than %d headers", connID, *maxHeaderCount)
+		respond(client, &stats, http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	if req.ProtoMajor < 1 {
+		connLogf("[Client %s] Rejecting %s request", connID, req.Proto)
+		respond(client, &stats, http.StatusBadRequest)
+		return
+	}
+
+	if req.Method == "GET" && *pacPath != "" && req.URL.Path == *pacPath {
+		connLogf("[Client %s] Serving PAC script", connID)
+		servePAC(client, req)
+		stats.Status = http.StatusOK
+		return
+	}
+
+	if req.Method == "GET" && *infoPage && req.URL.Path == "/" && req.URL.Host == "" {
+		connLogf("[Client %s] Serving info page", connID)
+		serveInfoPage(client)
+		stats.Status = http.StatusOK
 		return
 	}
 
 	// only support CONNECT
 	if req.Method != "CONNECT" {
-		log.Printf("[Client %s]Invalid request method: %s", remoteAddr, req.Method)
+		connLogf("[Client %s] Invalid request method: %s %s", connID, req.Method, logURL(req.URL))
+		respondConnectOnly(client, &stats)
 		return
 	}
 
 	// parse target host and port
 	hostPort := req.URL.Host
-	log.Printf("[Client %s] Target host: %s", remoteAddr, hostPort)
-	if isBlocked(hostPort) {
-		log.Printf("[Client: %s] Blocked host: %s", remoteAddr, hostPort)
+	connLogf("[Client %s] Target host: %s", connID, logHost(hostPort))
+	stats.Target = hostPort
+	eventTarget(&stats)
+	if rule, blocked := matchBlock(hostPort); blocked {
+		connLogf("[Client: %s] Blocked host: %s", connID, logHost(hostPort))
+		eventBlock(&stats)
+		audit(&stats, decisionBlocked, rule, start)
 		// send teapot response
-		client.Write([]byte("HTTP/1.1 418 I'm a teapot\r\n\r\n"))
+		respond(client, &stats, http.StatusTeapot)
 		return
 	}
-	if !strings.Contains(hostPort, ":") {
-		hostPort = hostPort + ":443" // https as default
+	if _, _, err := net.SplitHostPort(hostPort); err != nil && *requirePort {
+		connLogf("[Client %s] Rejecting CONNECT without port: %s", connID, logHost(hostPort))
+		respond(client, &stats, http.StatusBadRequest)
+		audit(&stats, decisionRejected, "require-port", start)
+		return
+	}
+	hostPort = withDefaultPort(hostPort, "443") // https as default
+	_, port, _ := net.SplitHostPort(hostPort)
+	if allowedPorts != nil && !allowedPorts[port] {
+		connLogf("[Client %s] Rejecting CONNECT to disallowed port: %s", connID, logHost(hostPort))
+		respond(client, &stats, http.StatusForbidden)
+		audit(&stats, decisionRejected, "connect-ports", start)
+		return
+	}
+
+	if !acquireTunnel() {
+		connLogf("[Client %s] Too many tunnels, rejecting %s", connID, logHost(hostPort))
+		respond(client, &stats, http.StatusServiceUnavailable)
+		audit(&stats, decisionRejected, "max-tunnels", start)
+		return
 	}
+	defer releaseTunnel()
 
 	// connect to server
-	server, err := net.Dial("tcp", hostPort)
+	upstream, err := dialTarget(serverCtx, hostPort)
+	var blocked *blockedDialError
+	if errors.As(err, &blocked) {
+		connLogf("[Client %s] Blocked target address of %s: %v", connID, logHost(hostPort), logDialError(err))
+		eventBlock(&stats)
+		audit(&stats, decisionBlocked, blocked.rule, start)
+		respond(client, &stats, http.StatusTeapot)
+		return
+	}
 	if err != nil {
-		log.Printf("[Client %s] Error connecting to %v: %v", remoteAddr, hostPort, err)
+		log.Printf("[Client %s] Error connecting to %v: %v", connID, logHost(hostPort), logDialError(err))
+		audit(&stats, decisionFailed, "", start)
+		status := http.StatusBadGateway
+		if errors.Is(err, errCircuitOpen) || errors.Is(err, errUpstreamLimit) || errors.Is(err, context.Canceled) {
+			status = http.StatusServiceUnavailable
+		}
+		respond(client, &stats, status)
 		return
 	}
+	server := &closeOnceConn{Conn: upstream}
 	defer server.Close()
-
-	// log data transferred
-	clientCounting := &countingConn{Conn: client}
-	serverCounting := &countingConn{Conn: server}
+	audit(&stats, decisionConnected, "", start)
 
 	resp := "HTTP/1.1 200 Connection Established\r\n"
-	resp += "Proxy-agent: go-tunnel-proxy\r\n"
+	resp += "Proxy-agent: " + proxyAgent() + "\r\n"
+	resp += "Via: 1.1 " + proxyAgent() + "\r\n"
 	resp += "Connection: close\r\n\r\n"
 	client.Write([]byte(resp))
+	stats.Status = http.StatusOK
 
-	go io.Copy(server, client)
-	io.Copy(client, server)
+	if *checkTLSPort && port == "443" {
+		if !looksLikeTLS(client, clientReader) {
+			connLogf("[Client %s] Rejecting non-TLS traffic to %s", connID, logHost(hostPort))
+			return
+		}
+		connLogf("[Client %s] TLS handshake detected for %s", connID, logHost(hostPort))
+	}
 
-	log.Printf(
-		"[Client %s] Data transferred: sent %d bytes, received %d bytes",
-		remoteAddr,
-		clientCounting.bytesWritten,
-		serverCounting.bytesRead,
-	)
+	if *checkSNI && sniPorts[port] {
+		if sni := peekSNI(client, clientReader); sni != "" {
+			if host, _, _ := net.SplitHostPort(hostPort); !strings.EqualFold(host, sni) {
+				connLogf("[Client %s] TLS server name %s differs from CONNECT target %s", connID, logHost(sni), logHost(hostPort))
+			}
+			if rule, blocked := matchBlock(net.JoinHostPort(sni, port)); blocked {
+				connLogf("[Client %s] Blocked TLS server name: %s", connID, logHost(sni))
+				eventBlock(&stats)
+				audit(&stats, decisionBlocked, rule, start)
+				return
+			}
+		}
+	}
+
+	if *sendProxyProtocol != "" {
+		if err := writeProxyHeader(server, *sendProxyProtocol, client.RemoteAddr(), server.RemoteAddr()); err != nil {
+			log.Printf("[Client %s] Error sending PROXY header: %v", connID, err)
+			return
+		}
+	}
+
+	// bytes the client sent after the CONNECT may already be buffered
+	transfer(connID, &bufferedConn{Conn: client, reader: clientReader}, server, &stats)
 }
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "10000" // default port
+// handleTransparentConnection tunnels a connection that was redirected to the
+// proxy by the firewall, using the original destination instead of a CONNECT.
+func handleTransparentConnection(conn net.Conn) {
+	client := &closeOnceConn{Conn: conn}
+	defer client.Close()
+	// connID tags every log line of this connection; until the connection
+	// is registered, a panic is reported with the client address
+	connID := conn.RemoteAddr().String()
+	defer recoverHandler(&connID)
+	remoteAddr := extractIPv4FromRemoteAddr(client.RemoteAddr().String())
+	ip := clientIP(client.RemoteAddr().String())
+	stats := Stats{ClientIP: ip}
+	start := time.Now()
+	defer eventClose(&stats, start)
+	eventAccept(&stats)
+	connID = fmt.Sprintf("%s conn=%d", remoteAddr, stats.conn.id)
+	connLogf("[Client %s] Received transparent connection", connID)
+	defer connLogf("[Client %s] Connection closed", connID)
+
+	if clientLimiter != nil {
+		if !clientLimiter.acquire(ip) {
+			connLogf("[Client %s] Too many connections from client, rejecting", connID)
+			return
+		}
+		defer clientLimiter.release(ip)
 	}
 
-	err := loadBlacklist("blacklist.txt")
+	hostPort, err := originalDst(client)
 	if err != nil {
-		log.Fatalf("Failed to load blacklist: %v", err)
+		log.Printf("[Client %s] Error reading original destination: %v", connID, err)
+		return
+	}
+	stats.request = logHost(hostPort)
+	connLogf("[Client %s] Target host: %s", connID, logHost(hostPort))
+	stats.Target = hostPort
+	eventTarget(&stats)
+	if rule, blocked := matchBlock(hostPort); blocked {
+		connLogf("[Client: %s] Blocked host: %s", connID, logHost(hostPort))
+		eventBlock(&stats)
+		audit(&stats, decisionBlocked, rule, start)
+		return
+	}
+
+	if !acquireTunnel() {
+		connLogf("[Client %s] Too many tunnels, rejecting %s", connID, logHost(hostPort))
+		audit(&stats, decisionRejected, "max-tunnels", start)
+		return
+	}
+	defer releaseTunnel()
+
+	upstream, err := dialTarget(serverCtx, hostPort)
+	var blocked *blockedDialError
+	if errors.As(err, &blocked) {
+		connLogf("[Client %s] Blocked target address of %s: %v", connID, logHost(hostPort), logDialError(err))
+		eventBlock(&stats)
+		audit(&stats, decisionBlocked, blocked.rule, start)
+		return
 	}
-	listenAddr := fmt.Sprintf(":%s", port)
-	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", listenAddr, err)
+		log.Printf("[Client %s] Error connecting to %v: %v", connID, logHost(hostPort), logDialError(err))
+		audit(&stats, decisionFailed, "", start)
 		return
 	}
-	defer listener.Close()
+	server := &closeOnceConn{Conn: upstream}
+	defer server.Close()
+	audit(&stats, decisionConnected, "", start)
+
+	if *sendProxyProtocol != "" {
+		if err := writeProxyHeader(server, *sendProxyProtocol, client.RemoteAddr(), server.RemoteAddr()); err != nil {
+			log.Printf("[Client %s] Error sending PROXY header: %v", connID, err)
+			return
+		}
+	}
+
+	transfer(connID, client, server, &stats)
+}
+
+// recoverHandler, deferred first by the handlers, logs a panic of the
+// connection *connID with its stack and lets the server keep running. It
+// runs after the handler's other deferred calls, so it also covers a panic in
+// those, and the connection is still closed.
+func recoverHandler(connID *string) {
+	if r := recover(); r != nil {
+		log.Printf("[Client %s] Panic in handler: %v\n%s", *connID, r, debug.Stack())
+	}
+}
+
+// transfer tunnels between client and server, recording the byte counts in
+// stats.
+func transfer(connID string, client, server net.Conn, stats *Stats) {
+	tuneTCP(client)
+	tuneTCP(server)
+
+	if *logMTLS || *logTLSParams {
+		server = &observedConn{Conn: server, observer: newTLSObserver(func(msgType byte, body []byte) {
+			switch {
+			case msgType == handshakeTypeServerHello && *logTLSParams:
+				if version, cipher, ok := parseServerHello(body); ok {
+					connLogf("[Client %s] TLS with %s: %s, %s", connID, logHost(stats.Target), tls.VersionName(version), tls.CipherSuiteName(cipher))
+				}
+			case msgType == handshakeTypeCertificateRequest && *logMTLS:
+				connLogf("[Client %s] Server %s requested a client certificate (mutual TLS)", connID, logHost(stats.Target))
+			}
+		})}
+	}
+
+	ctx := tunnelCtx
+	if *maxConnDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(tunnelCtx, *maxConnDuration)
+		defer cancel()
+	}
+
+	client = stats.conn.count(client)
+	if *idleTimeout > 0 {
+		client = newIdleConn(client, *idleTimeout)
+		server = newIdleConn(server, *idleTimeout)
+	}
+
+	tunnelStats, err := tunnel.Options{Limit: *maxBytes, Copy: copyPooled}.Tunnel(ctx, client, server)
+	if errors.Is(err, tunnel.ErrQuotaExceeded) {
+		connLogf("[Client %s] Quota of %d bytes exceeded, closing connection", connID, *maxBytes)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		connLogf("[Client %s] Tunnel reached -max-conn-duration of %v, closed", connID, *maxConnDuration)
+	}
+
+	// log data transferred
+	stats.BytesIn = tunnelStats.BytesIn
+	stats.BytesOut = tunnelStats.BytesOut
+	connLogf(
+		"[Client %s] Data transferred: sent %d bytes, received %d bytes",
+		connID,
+		stats.BytesOut,
+		stats.BytesIn,
+	)
+}
 
-	log.Printf("Listening on %s", listenAddr)
+// serve accepts connections on listener and handles each in its own goroutine.
+// Temporary accept errors, such as running out of file descriptors, are
+// retried with exponential backoff up to -accept-backoff-max. serve returns
+// nil once the listener is closed and the error for any other failure.
+func serve(listener net.Listener, handle func(net.Conn)) error {
+	var delay time.Duration
 	for {
 		client, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
-			log.Println("Error accepting:", err)
-			continue
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay = min(delay*2, *acceptBackoffMax)
+				}
+				log.Printf("Error accepting: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			handle(client)
+		}()
+	}
+}
+
+// drain waits up to timeout for running handlers to finish, then closes the
+// tunnels that are still open and gives their handlers a moment to return.
+func drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Shutdown timeout reached, closing remaining connections")
+		stopTunnels()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// checkPolicy reports the rule that would refuse a CONNECT to hostPort, for
+// -check: the blacklist and -rules, -connect-ports, and, with -block-private
+// or -geo-db, a literal IP target or the addresses hostPort resolves to when
+// it is dialed directly.
+func checkPolicy(hostPort string) (string, bool) {
+	if rule, blocked := matchBlock(hostPort); blocked {
+		return rule, true
+	}
+	hostPort = withDefaultPort(hostPort, "443")
+	_, port, _ := net.SplitHostPort(hostPort)
+	if allowedPorts != nil && !allowedPorts[port] {
+		return "connect-ports", true
+	}
+	if !*blockPrivate && geoBlock == nil {
+		return "", false
+	}
+
+	if rewriteTarget(hostPort) != hostPort {
+		return "", false // rewrites are exempt from the address policy
+	}
+	ctx := withTargetDial(context.Background())
+	var blocked *blockedDialError
+	if errors.As(checkTargetAddr(ctx, hostPort), &blocked) {
+		return blocked.rule, true // a literal IP, however it is routed
+	}
+	if route := matchRoute(hostPort); route != nil && route.upstream != nil {
+		return "", false // the upstream proxy resolves and dials it
+	}
+	if *respectEnvProxy {
+		if proxyURL, _ := envProxyURL(hostPort); proxyURL != nil {
+			return "", false
+		}
+	}
+	host, _, _ := net.SplitHostPort(hostPort)
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		log.Printf("Warning: address policy not checked: %v", err)
+		return "", false
+	}
+	for _, ip := range ips {
+		if errors.As(checkTargetAddr(ctx, net.JoinHostPort(ip.IP.String(), port)), &blocked) {
+			return blocked.rule, true
+		}
+	}
+	return "", false
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if err := loadEnv(); err != nil {
+		log.Fatalf("Failed to load environment: %v", err)
+	}
+
+	// a reload may only move the listener if its address is not pinned by
+	// the command line or environment
+	reloadListen := *configPath != "" && !explicitFlags()["listen"]
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
+	if *transparent && !transparentSupported {
+		log.Fatalf("Invalid -transparent: only supported on linux")
+	}
+
+	if *maxTunnels > 0 {
+		tunnelSlots = make(chan struct{}, *maxTunnels)
+	}
+
+	if err := checkIntervals(); err != nil {
+		log.Fatalf("Invalid %v", err)
+	}
+
+	switch *emptyBlacklist {
+	case "allow", "deny":
+	default:
+		log.Fatalf("Invalid -empty-blacklist %q, want allow or deny", *emptyBlacklist)
+	}
+
+	switch *maskHosts {
+	case "", "tld", "domain", "hash":
+	default:
+		log.Fatalf("Invalid -mask-hosts %q, want tld, domain or hash", *maskHosts)
+	}
+
+	switch *sendProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		log.Fatalf("Invalid -send-proxy-protocol %q, want v1 or v2", *sendProxyProtocol)
+	}
+
+	if *sourceIP != "" {
+		addr, err := parseSourceIP(*sourceIP)
+		if err != nil {
+			log.Fatalf("Invalid -source-ip: %v", err)
+		}
+		sourceAddr = addr
+	}
+
+	if *connectPorts != "" {
+		ports, err := parsePorts(*connectPorts)
+		if err != nil {
+			log.Fatalf("Invalid -connect-ports: %v", err)
+		}
+		allowedPorts = ports
+	}
+
+	if *checkSNI {
+		ports, err := parsePorts(*checkSNIPorts)
+		if err != nil {
+			log.Fatalf("Invalid -check-sni-ports: %v", err)
+		}
+		sniPorts = ports
+	}
+
+	if *maxUpstream > 0 {
+		upstreamSlots = make(chan struct{}, *maxUpstream)
+	}
+
+	if *breakerFailures > 0 {
+		targetBreaker = newCircuitBreaker(*breakerFailures, *breakerWindow, *breakerCooldown)
+		go targetBreaker.sweepLoop()
+	}
+
+	if *perIPConns > 0 || *perIPRate > 0 {
+		clientLimiter = newIPLimiter(*perIPConns, *perIPRate, *perIPBurst)
+		go clientLimiter.sweepLoop()
+	}
+
+	if *blacklistPath != "" {
+		if err := loadStartupBlacklist(*blacklistPath); err != nil {
+			log.Fatalf("Failed to load blacklist: %v", err)
+		}
+	}
+
+	if *upstreamCA != "" {
+		pool, err := loadCertPool(*upstreamCA)
+		if err != nil {
+			log.Fatalf("Failed to load -upstream-ca: %v", err)
+		}
+		upstreamRootCAs = pool
+	}
+
+	if *rewriteSpec != "" {
+		list, err := parseRewrites(*rewriteSpec)
+		if err != nil {
+			log.Fatalf("Invalid -rewrite: %v", err)
+		}
+		rewrites = list
+	}
+
+	if *geoDBPaths != "" && (*blockCountries != "" || *blockASNs != "") {
+		policy, err := newGeoPolicy(*geoDBPaths, *blockCountries, *blockASNs)
+		if err != nil {
+			log.Fatalf("Failed to load -geo-db: %v", err)
+		}
+		geoBlock = policy
+	}
+
+	if *rulesPath != "" {
+		rules, err := loadRules(*rulesPath)
+		if err != nil {
+			log.Fatalf("Failed to load rules: %v", err)
+		}
+		routes = rules
+	}
+
+	if *checkHost != "" {
+		if rule, blocked := checkPolicy(*checkHost); blocked {
+			fmt.Printf("blocked (rule: %s)\n", rule)
+			os.Exit(1)
+		}
+		fmt.Println("allowed")
+		return
+	}
+
+	// background work starts only once -check has had its chance to exit
+	if *blacklistPath != "" && isBlacklistURL(*blacklistPath) && *blacklistRefresh > 0 {
+		go refreshBlacklistLoop(*blacklistPath, *blacklistRefresh)
+	}
+
+	if *influxURL != "" {
+		go pushInfluxMetrics(*influxURL, *influxInterval)
+	}
+
+	if *statsdAddr != "" {
+		client, err := newStatsdClient(*statsdAddr)
+		if err != nil {
+			log.Fatalf("Failed to set up StatsD: %v", err)
+		}
+		statsd = client
+	}
+
+	if *otelEndpoint != "" {
+		spanQueue = make(chan otlpSpan, maxQueuedSpans)
+		go exportSpans(*otelEndpoint, *otelInterval)
+	}
+
+	switch *checkUpstream {
+	case "":
+	case "warn", "exit":
+		if failed := checkUpstreams(serverCtx); failed > 0 && *checkUpstream == "exit" {
+			log.Fatalf("%d upstream proxies unreachable", failed)
+		}
+	default:
+		log.Fatalf("Invalid -check-upstream %q, want warn or exit", *checkUpstream)
+	}
+
+	addr := *listenAddr
+	if addr == "" {
+		addr = defaultListenAddr
+	}
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+		return
+	}
+
+	var wrap func(net.Listener) net.Listener
+	if *tlsCert != "" {
+		config, reloader, err := newListenerTLSConfig()
+		if err != nil {
+			log.Fatalf("Failed to load TLS config: %v", err)
+		}
+		wrap = func(l net.Listener) net.Listener {
+			return tls.NewListener(l, config)
+		}
+		listener = wrap(listener)
+
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := reloader.reload(); err != nil {
+					log.Printf("Error reloading TLS certificate: %v", err)
+					continue
+				}
+				log.Printf("Reloaded TLS certificate")
+			}
+		}()
+	}
+
+	live := newLiveListener(addr, listener, wrap)
+	defer live.close()
+	if reloadListen {
+		go reloadListenOnHUP(*configPath, live)
+	}
+	go dumpConnsOnUSR1()
+
+	if *adminAddr != "" {
+		if err := startAdmin(*adminAddr); err != nil {
+			log.Fatalf("Failed to start admin API: %v", err)
+		}
+	}
+
+	if *pprofAddr != "" {
+		if err := startPprof(*pprofAddr); err != nil {
+			log.Fatalf("Failed to start pprof: %v", err)
 		}
+	}
 
-		go handleClientConnection(client)
+	if *accessLogPath != "" {
+		accessLog, err = openLogFile(*accessLogPath, *accessLogMaxSize)
+		if err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+	}
+	if *auditLogPath != "" {
+		auditLog, err = openLogFile(*auditLogPath, 0)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+	}
+
+	// close the listener on shutdown so a unix socket file is cleaned up
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-shutdown
+		log.Printf("Received %v, shutting down", sig)
+		stopServer()
+		live.close()
+	}()
+
+	log.Printf("Listening on %s", addr)
+	handle := handleClientConnection
+	if *transparent {
+		handle = handleTransparentConnection
+	}
+	if err := live.serve(handle); err != nil {
+		log.Fatalf("Error accepting: %v", err)
 	}
+	drain(*shutdownTimeout)
 }
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMain keeps the proxy's log lines out of the test output; tests that
+// look at them use captureLog.
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// setFlag sets the command-line flag name for the duration of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("no flag -%s", name)
+	}
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatalf("-%s=%s: %v", name, value, err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects the standard logger to a buffer for the test.
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return buf
+}
+
+// startProxy serves handle on a loopback listener and returns its address.
+func startProxy(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(listener, handle)
+	t.Cleanup(func() {
+		listener.Close()
+		handlers.Wait()
+	})
+	return listener.Addr().String()
+}
+
+// startEcho runs a TCP server that echoes what it reads and returns its
+// address.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// connect sends a CONNECT for target to the proxy at proxyAddr and returns
+// the connection, a reader positioned after the response header, and the
+// response status.
+func connect(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("CONNECT %s: %v", target, err)
+	}
+	return conn, reader, resp.StatusCode
+}
+
+// sendRaw writes request to the proxy at proxyAddr and returns everything
+// it answers until it closes the connection.
+func sendRaw(t *testing.T, proxyAddr, request string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, request)
+	resp, _ := io.ReadAll(conn)
+	return string(resp)
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	tests := []struct {
+		hostPort, want string
+	}{
+		{"10.0.0.1", "10.0.0.1:443"},
+		{"10.0.0.1:8443", "10.0.0.1:8443"},
+		{"[2001:db8::1]", "[2001:db8::1]:443"},
+		{"[2001:db8::1]:8443", "[2001:db8::1]:8443"},
+		{"2001:db8::1", "[2001:db8::1]:443"},
+		{"example.com", "example.com:443"},
+		{"example.com:80", "example.com:80"},
+	}
+	for _, tt := range tests {
+		if got := withDefaultPort(tt.hostPort, "443"); got != tt.want {
+			t.Errorf("withDefaultPort(%q) = %q, want %q", tt.hostPort, got, tt.want)
+		}
+	}
+}
+
+func TestConnectDefaultsToPort443(t *testing.T) {
+	allowedPorts = map[string]bool{"443": true}
+	t.Cleanup(func() { allowedPorts = nil })
+	proxy := startProxy(t, handleClientConnection)
+
+	// a portless authority passes the port check as 443, then fails to dial
+	for _, target := range []string{"127.0.0.1", "[::1]"} {
+		if _, _, status := connect(t, proxy, target); status == http.StatusForbidden {
+			t.Errorf("CONNECT %s: got 403, want the default port 443 to be allowed", target)
+		}
+	}
+	if _, _, status := connect(t, proxy, "127.0.0.1:25"); status != http.StatusForbidden {
+		t.Errorf("CONNECT 127.0.0.1:25: status %d, want 403", status)
+	}
+}
+
+// logged reports whether the log buffer contains s.
+func logged(buf *syncBuffer, s string) bool {
+	return strings.Contains(buf.String(), s)
+}
+
+// waitLogged waits briefly for s to appear in the log.
+func waitLogged(buf *syncBuffer, s string) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if logged(buf, s) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestMaxTunnels(t *testing.T) {
+	setFlag(t, "accept-queue", "0")
+	tunnelSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { tunnelSlots = nil })
+	echo := startEcho(t)
+	proxy := startProxy(t, handleClientConnection)
+
+	first, _, status := connect(t, proxy, echo)
+	if status != http.StatusOK {
+		t.Fatalf("first CONNECT: status %d", status)
+	}
+	if _, _, status := connect(t, proxy, echo); status != http.StatusServiceUnavailable {
+		t.Errorf("CONNECT over the limit: status %d, want 503", status)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(tunnelSlots) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, _, status := connect(t, proxy, echo); status != http.StatusOK {
+		t.Errorf("CONNECT after a tunnel closed: status %d, want 200", status)
+	}
+}
+
+func TestLogURL(t *testing.T) {
+	u, _ := url.Parse("http://example.com/reset/abc123?token=secret")
+	tests := []struct {
+		redact, pathOnly string
+		want             string
+	}{
+		{"false", "false", "http://example.com/reset/abc123?token=secret"},
+		{"false", "true", "http://example.com/reset/abc123"},
+		{"true", "false", "http://example.com/[redacted]"},
+	}
+	for _, tt := range tests {
+		setFlag(t, "redact-urls", tt.redact)
+		setFlag(t, "log-path-only", tt.pathOnly)
+		if got := logURL(u); got != tt.want {
+			t.Errorf("redact=%s path-only=%s: logURL = %q, want %q", tt.redact, tt.pathOnly, got, tt.want)
+		}
+	}
+}
+
+func TestRedactedURLsStayOutOfTheLog(t *testing.T) {
+	setFlag(t, "log-path-only", "true")
+	logs := captureLog(t)
+	proxy := startProxy(t, handleClientConnection)
+
+	sendRaw(t, proxy, "GET http://example.com/login?token=secret HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if !logged(logs, "http://example.com/login") {
+		t.Errorf("request not logged; log: %s", logs)
+	}
+	if logged(logs, "secret") {
+		t.Errorf("query string logged: %s", logs)
+	}
+}
+
+func TestMaxBytesEndsTunnel(t *testing.T) {
+	setFlag(t, "max-bytes", "1000")
+	echo := startEcho(t)
+	proxy := startProxy(t, handleClientConnection)
+
+	conn, reader, status := connect(t, proxy, echo)
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT: status %d", status)
+	}
+	go conn.Write(make([]byte, 5000))
+	n, _ := io.Copy(io.Discard, reader)
+	if n > 1000 {
+		t.Errorf("received %d bytes through a 1000 byte quota", n)
+	}
+}
+
+func TestRequirePort(t *testing.T) {
+	allowedPorts = map[string]bool{"1": true}
+	t.Cleanup(func() { allowedPorts = nil })
+	proxy := startProxy(t, handleClientConnection)
+
+	// a defaulted port 443 is refused by the port allowlist, so 403 shows
+	// that the authority was accepted
+	setFlag(t, "require-port", "false")
+	if _, _, status := connect(t, proxy, "example.com"); status != http.StatusForbidden {
+		t.Errorf("without -require-port: status %d, want the default port (403 here)", status)
+	}
+	setFlag(t, "require-port", "true")
+	if _, _, status := connect(t, proxy, "example.com"); status != http.StatusBadRequest {
+		t.Errorf("with -require-port: status %d, want 400", status)
+	}
+	if _, _, status := connect(t, proxy, "example.com:443"); status != http.StatusForbidden {
+		t.Errorf("with -require-port and a port: status %d, want it accepted (403 here)", status)
+	}
+}
+
+// closeCounter counts calls to Close.
+type closeCounter struct {
+	net.Conn
+	mu     sync.Mutex
+	closes int
+}
+
+func (c *closeCounter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closes++
+	if c.closes > 1 {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func TestCloseOnceConn(t *testing.T) {
+	inner := &closeCounter{}
+	conn := &closeOnceConn{Conn: inner}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := conn.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if inner.closes != 1 {
+		t.Errorf("underlying Close called %d times, want 1", inner.closes)
+	}
+	if conn.NetConn() != inner {
+		t.Error("NetConn doesn't return the wrapped connection")
+	}
+}
+
+// flakyListener fails Accept with errs in turn, then with a permanent error.
+type flakyListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) == 0 {
+		return nil, errors.New("permanent failure")
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+// temporaryError is a net.Error that reports itself as temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestServeBacksOffOnTemporaryErrors(t *testing.T) {
+	setFlag(t, "accept-backoff-max", "20ms")
+	logs := captureLog(t)
+	listener := &flakyListener{errs: []error{temporaryError{}, temporaryError{}, temporaryError{}}}
+
+	start := time.Now()
+	err := serve(listener, func(net.Conn) { t.Error("handler called") })
+	if err == nil || err.Error() != "permanent failure" {
+		t.Errorf("serve returned %v, want the permanent error", err)
+	}
+	// 5ms, 10ms, then 20ms capped by -accept-backoff-max
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("returned after %v, want a growing backoff", elapsed)
+	}
+	if strings.Count(logs.String(), "retrying in") != 3 {
+		t.Errorf("want three retries logged; log: %s", logs)
+	}
+	if !logged(logs, "retrying in 20ms") {
+		t.Errorf("backoff not capped at 20ms; log: %s", logs)
+	}
+}
+
+func TestServeReturnsNilWhenClosed(t *testing.T) {
+	listener := &flakyListener{errs: []error{net.ErrClosed}}
+	if err := serve(listener, func(net.Conn) {}); err != nil {
+		t.Errorf("serve on a closed listener returned %v", err)
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	useBlacklist(t, "bad.example")
+	allowedPorts = map[string]bool{"443": true}
+	t.Cleanup(func() { allowedPorts = nil })
+
+	tests := []struct {
+		blockPrivate, hostPort string
+		rule                   string
+	}{
+		{"false", "bad.example:443", "bad.example"},
+		{"false", "bad.example.org", "bad.example"},
+		{"false", "good.example:443", ""},
+		{"false", "good.example", ""},
+		{"false", "good.example:25", "connect-ports"},
+		{"false", "127.0.0.1:443", ""},
+		{"true", "127.0.0.1:443", "private:loopback"},
+		{"true", "[::1]:443", "private:loopback"},
+		{"true", "localhost:443", "private:loopback"},
+		{"true", "8.8.8.8:443", ""},
+	}
+	for _, tt := range tests {
+		setFlag(t, "block-private", tt.blockPrivate)
+		rule, blocked := checkPolicy(tt.hostPort)
+		if rule != tt.rule || blocked != (tt.rule != "") {
+			t.Errorf("block-private=%s: checkPolicy(%q) = %q, %v; want %q", tt.blockPrivate, tt.hostPort, rule, blocked, tt.rule)
+		}
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	proxy := startProxy(t, handleClientConnection)
+	for _, request := range []string{
+		"GET / HTTP/0.9\r\n\r\n",
+		"GET /\r\n\r\n",
+		"\x16\x03\x01\x00\x05hello\r\n\r\n",
+		"CONNECT example.com:443 HTTP/1.1\r\nbad header\r\n\r\n",
+	} {
+		if resp := sendRaw(t, proxy, request); resp != "HTTP/1.1 400 Bad Request\r\n\r\n" {
+			t.Errorf("%q: response %q, want 400", request, resp)
+		}
+	}
+	// a client that hangs up early gets no response
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\n")
+	conn.(*net.TCPConn).CloseWrite()
+	if resp, _ := io.ReadAll(conn); len(resp) != 0 {
+		t.Errorf("truncated request: response %q, want none", resp)
+	}
+}
+
+func TestMaxHeaderCount(t *testing.T) {
+	setFlag(t, "max-header-count", "2")
+	proxy := startProxy(t, handleClientConnection)
+	echo := startEcho(t)
+
+	// connect sends only Host, which is not counted
+	if _, _, status := connect(t, proxy, echo); status != http.StatusOK {
+		t.Errorf("no headers: status %d, want 200", status)
+	}
+	// repeated fields count once per line
+	request := "CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\nX-A: 1\r\nX-A: 2\r\nX-B: 3\r\n\r\n"
+	if resp := sendRaw(t, proxy, request); !strings.HasPrefix(resp, "HTTP/1.1 431 ") {
+		t.Errorf("three headers: %q, want 431", resp)
+	}
+}
+
+// useRewrites installs the -rewrite list spec for the test.
+func useRewrites(t *testing.T, spec string) {
+	t.Helper()
+	list, err := parseRewrites(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrites = list
+	t.Cleanup(func() { rewrites = nil })
+}
+
+func TestCheckTLS443(t *testing.T) {
+	setFlag(t, "check-tls-443", "true")
+	useRewrites(t, "tls.test="+startEcho(t))
+	proxy := startProxy(t, handleClientConnection)
+
+	for _, tt := range []struct {
+		data    string
+		relayed bool
+	}{
+		{"\x16\x03\x01\x00\x05hello", true},
+		{"GET / HTTP/1.1\r\n\r\n", false},
+	} {
+		conn, reader, status := connect(t, proxy, "tls.test:443")
+		if status != http.StatusOK {
+			t.Fatalf("CONNECT: status %d", status)
+		}
+		io.WriteString(conn, tt.data)
+		buf := make([]byte, len(tt.data))
+		_, err := io.ReadFull(reader, buf)
+		if relayed := err == nil && string(buf) == tt.data; relayed != tt.relayed {
+			t.Errorf("%q: relayed %v, want %v (err %v)", tt.data, relayed, tt.relayed, err)
+		}
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	setFlag(t, "header-timeout", "100ms")
+	proxy := startProxy(t, handleClientConnection)
+
+	// the header never ends
+	if resp := sendRaw(t, proxy, "CONNECT example.com:443 HTTP/1.1\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 408 ") {
+		t.Errorf("incomplete header: %q, want 408", resp)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	setFlag(t, "max-header-bytes", "256")
+	proxy := startProxy(t, handleClientConnection)
+
+	request := "CONNECT example.com:443 HTTP/1.1\r\nX-Pad: " + strings.Repeat("a", 300) + "\r\n\r\n"
+	if resp := sendRaw(t, proxy, request); !strings.HasPrefix(resp, "HTTP/1.1 431 ") {
+		t.Errorf("oversized header: %q, want 431", resp)
+	}
+	// the limit covers only the header, not the tunnel
+	echo := startEcho(t)
+	conn, reader, status := connect(t, proxy, echo)
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT: status %d", status)
+	}
+	data := strings.Repeat("b", 1000)
+	io.WriteString(conn, data)
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Errorf("tunnel after the header limit: %v", err)
+	}
+}
+
+func TestConnectionIDsInLog(t *testing.T) {
+	logs := captureLog(t)
+	proxy := startProxy(t, handleClientConnection)
+
+	for i := 0; i < 3; i++ {
+		sendRaw(t, proxy, "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	}
+	ids := make(map[string]bool)
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if _, rest, ok := strings.Cut(line, " conn="); ok {
+			id, _, _ := strings.Cut(rest, "]")
+			ids[id] = true
+		}
+	}
+	if len(ids) != 3 {
+		t.Errorf("got connection ids %v, want 3 distinct; log: %s", ids, logs)
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("443, 8443")
+	if err != nil || len(ports) != 2 || !ports["443"] || !ports["8443"] {
+		t.Errorf("parsePorts = %v, %v", ports, err)
+	}
+	for _, bad := range []string{"", "0", "65536", "https", "443,,8443"} {
+		if _, err := parsePorts(bad); err == nil {
+			t.Errorf("parsePorts(%q) accepted", bad)
+		}
+	}
+}
+
+func TestConnectPorts(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	allowedPorts, _ = parsePorts("443," + port)
+	t.Cleanup(func() { allowedPorts = nil })
+	proxy := startProxy(t, handleClientConnection)
+
+	if _, _, status := connect(t, proxy, "127.0.0.1:25"); status != http.StatusForbidden {
+		t.Errorf("CONNECT to port 25: status %d, want 403", status)
+	}
+	if _, _, status := connect(t, proxy, echo); status != http.StatusOK {
+		t.Errorf("CONNECT to an allowed port: status %d, want 200", status)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	setFlag(t, "quiet", "true")
+	logs := captureLog(t)
+	proxy := startProxy(t, handleClientConnection)
+
+	sendRaw(t, proxy, "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if logged(logs, "[Client ") {
+		t.Errorf("per-connection lines logged with -quiet: %s", logs)
+	}
+	// errors are still logged
+	sendRaw(t, proxy, "garbage\r\n\r\n")
+	if !logged(logs, "Error reading request") {
+		t.Errorf("error not logged with -quiet; log: %s", logs)
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	logs := captureLog(t)
+	connID := "127.0.0.1:5000"
+	func() {
+		defer recoverHandler(&connID)
+		connID = "127.0.0.1:5000 conn=7"
+		panic("boom")
+	}()
+	if !logged(logs, "[Client 127.0.0.1:5000 conn=7] Panic in handler: boom") {
+		t.Errorf("panic not logged with the current conn id; log: %s", logs)
+	}
+}
+
+func TestAcceptQueue(t *testing.T) {
+	setFlag(t, "accept-queue", "1")
+	setFlag(t, "accept-queue-timeout", "100ms")
+	tunnelSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { tunnelSlots = nil })
+	if !acquireTunnel() {
+		t.Fatal("first tunnel not admitted")
+	}
+
+	start := time.Now()
+	if acquireTunnel() {
+		t.Fatal("queued tunnel admitted while the slot is held")
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("queued tunnel rejected after %v, want -accept-queue-timeout", waited)
+	}
+
+	time.AfterFunc(20*time.Millisecond, releaseTunnel)
+	if !acquireTunnel() {
+		t.Error("queued tunnel not admitted when the slot freed")
+	}
+	releaseTunnel()
+}
+
+func TestAcceptQueueFull(t *testing.T) {
+	setFlag(t, "accept-queue", "0")
+	tunnelSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { tunnelSlots = nil })
+	acquireTunnel()
+	defer releaseTunnel()
+
+	start := time.Now()
+	if acquireTunnel() || time.Since(start) > 50*time.Millisecond {
+		t.Error("tunnel over the limit not rejected immediately with no queue")
+	}
+}
+
+func TestNonConnectMethods(t *testing.T) {
+	setFlag(t, "info-page", "false")
+	proxy := startProxy(t, handleClientConnection)
+	for _, method := range []string{"GET", "POST", "HEAD"} {
+		resp := sendRaw(t, proxy, method+" / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if want := "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\n\r\n"; resp != want {
+			t.Errorf("%s: response %q, want %q", method, resp, want)
+		}
+	}
+}
+
+func TestInfoPage(t *testing.T) {
+	setFlag(t, "info-page", "true")
+	proxy := startProxy(t, handleClientConnection)
+
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(
+		sendRaw(t, proxy, "GET / HTTP/1.1\r\nHost: proxy.example\r\n\r\n"))), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Allow") != "CONNECT" || !strings.Contains(string(body), "This is a CONNECT proxy") {
+		t.Errorf("GET /: %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+
+	// other paths and absolute-form requests still get 405
+	for _, target := range []string{"/index.html", "http://example.com/"} {
+		if resp := sendRaw(t, proxy, "GET "+target+" HTTP/1.1\r\nHost: example.com\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 405 ") {
+			t.Errorf("GET %s with -info-page: %q", target, resp)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"net"
+	"strings"
+)
+
+var maskHosts = flag.String("mask-hosts", "", `mask target hosts in logs: "tld" keeps only the top-level domain, "domain" keeps the last two labels, "hash" logs a short hash`)
+
+// logHost renders a target host or host:port for logging according to
+// -mask-hosts. The port is always kept.
+func logHost(hostPort string) string {
+	if *maskHosts == "" {
+		return hostPort
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = hostPort, ""
+	}
+	masked := maskHost(host, *maskHosts)
+	if port == "" {
+		return masked
+	}
+	return net.JoinHostPort(masked, port)
+}
+
+func maskHost(host, strategy string) string {
+	if strategy == "hash" {
+		sum := sha256.Sum256([]byte(host))
+		return "h-" + hex.EncodeToString(sum[:4])
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return "*.*.*." + strings.Split(ip4.String(), ".")[3]
+		}
+		return "*:" + host[strings.LastIndex(host, ":")+1:]
+	}
+
+	keep := 1
+	if strategy == "domain" {
+		keep = 2
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) <= keep {
+		return host
+	}
+	for i := range labels[:len(labels)-keep] {
+		labels[i] = "*"
+	}
+	return strings.Join(labels, ".")
+}
+
+// logDialError drops the address from a dial error when hosts are masked,
+// since the error text would otherwise repeat it unmasked. A failed lookup
+// keeps its text with the name masked.
+func logDialError(err error) error {
+	if *maskHosts == "" {
+		return err
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		masked := *dnsErr
+		masked.Name = logHost(dnsErr.Name)
+		return &masked
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Err
+	}
+	return err
+}
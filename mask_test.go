@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMaskHost(t *testing.T) {
+	tests := []struct {
+		host, strategy, want string
+	}{
+		{"www.example.com", "tld", "*.*.com"},
+		{"www.example.com", "domain", "*.example.com"},
+		{"example.com", "domain", "example.com"},
+		{"localhost", "tld", "localhost"},
+		{"10.1.2.3", "tld", "*.*.*.3"},
+		{"2001:db8::1", "domain", "*:1"},
+	}
+	for _, tt := range tests {
+		if got := maskHost(tt.host, tt.strategy); got != tt.want {
+			t.Errorf("maskHost(%q, %q) = %q, want %q", tt.host, tt.strategy, got, tt.want)
+		}
+	}
+
+	hashed := maskHost("www.example.com", "hash")
+	if !strings.HasPrefix(hashed, "h-") || len(hashed) != 10 || strings.Contains(hashed, "example") {
+		t.Errorf("maskHost hash = %q", hashed)
+	}
+	if hashed != maskHost("www.example.com", "hash") {
+		t.Error("hash is not stable")
+	}
+}
+
+func TestLogHostKeepsPort(t *testing.T) {
+	setFlag(t, "mask-hosts", "domain")
+	if got := logHost("www.example.com:8443"); got != "*.example.com:8443" {
+		t.Errorf("logHost = %q", got)
+	}
+	if got := logHost("[2001:db8::1]:443"); got != "[*:1]:443" {
+		t.Errorf("logHost = %q", got)
+	}
+}
+
+func TestLogDialErrorMasksHost(t *testing.T) {
+	setFlag(t, "mask-hosts", "tld")
+	dnsErr := &net.DNSError{Err: "no such host", Name: "secret.example.com", IsNotFound: true}
+	err := logDialError(&net.OpError{Op: "dial", Net: "tcp", Err: dnsErr})
+	if strings.Contains(err.Error(), "secret") || !strings.Contains(err.Error(), "no such host") {
+		t.Errorf("DNS error logged as %q", err)
+	}
+	if dnsErr.Name != "secret.example.com" {
+		t.Error("the original error was modified")
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 443}
+	refused := errors.New("connection refused")
+	err = logDialError(&net.OpError{Op: "dial", Net: "tcp", Addr: addr, Err: refused})
+	if err != refused {
+		t.Errorf("dial error logged as %q, want the address dropped", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	influxURL      = flag.String("influx-url", "", "InfluxDB write endpoint to push metrics to, e.g. http://localhost:8086/write?db=proxy")
+	influxInterval = flag.Duration("influx-interval", 10*time.Second, "interval between InfluxDB metric pushes")
+)
+
+// proxy-wide counters, updated atomically by the handlers
+var metrics struct {
+	connections int64
+	active      int64
+	blocked     int64
+	bytesIn     int64
+	bytesOut    int64
+}
+
+func recordAccept() {
+	atomic.AddInt64(&metrics.connections, 1)
+	atomic.AddInt64(&metrics.active, 1)
+}
+
+func recordBlock() {
+	atomic.AddInt64(&metrics.blocked, 1)
+}
+
+func recordClose(stats Stats) {
+	atomic.AddInt64(&metrics.active, -1)
+	atomic.AddInt64(&metrics.bytesIn, stats.BytesIn)
+	atomic.AddInt64(&metrics.bytesOut, stats.BytesOut)
+}
+
+// metricsSnapshot returns the current counters by name.
+func metricsSnapshot() map[string]int64 {
+	return map[string]int64{
+		"connections": atomic.LoadInt64(&metrics.connections),
+		"active":      atomic.LoadInt64(&metrics.active),
+		"blocked":     atomic.LoadInt64(&metrics.blocked),
+		"bytes_in":    atomic.LoadInt64(&metrics.bytesIn),
+		"bytes_out":   atomic.LoadInt64(&metrics.bytesOut),
+	}
+}
+
+func init() {
+	// served at /debug/vars by the admin API
+	expvar.Publish("proxy", expvar.Func(func() any {
+		return metricsSnapshot()
+	}))
+}
+
+// influxTagEscaper escapes a line protocol tag value.
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxLine formats the current counters as one InfluxDB line protocol point.
+func influxLine(host string, now time.Time) string {
+	return fmt.Sprintf(
+		"proxy,host=%s connections=%di,active=%di,blocked=%di,bytes_in=%di,bytes_out=%di %d\n",
+		influxTagEscaper.Replace(host),
+		atomic.LoadInt64(&metrics.connections),
+		atomic.LoadInt64(&metrics.active),
+		atomic.LoadInt64(&metrics.blocked),
+		atomic.LoadInt64(&metrics.bytesIn),
+		atomic.LoadInt64(&metrics.bytesOut),
+		now.UnixNano(),
+	)
+}
+
+// pushInfluxMetrics posts the counters to url every interval. It never returns.
+func pushInfluxMetrics(url string, interval time.Duration) {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "unknown"
+	}
+	client := &http.Client{Timeout: interval}
+
+	for now := range time.Tick(interval) {
+		if err := pushInflux(client, url, host, now); err != nil {
+			log.Printf("Error pushing metrics to InfluxDB: %v", err)
+		}
+	}
+}
+
+// pushInflux posts one point with the current counters to url.
+func pushInflux(client *http.Client, url, host string, now time.Time) error {
+	body := bytes.NewBufferString(influxLine(host, now))
+	resp, err := client.Post(url, "text/plain; charset=utf-8", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
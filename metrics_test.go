@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushInflux(t *testing.T) {
+	bodies := make(chan string, 1)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer sink.Close()
+
+	now := time.Unix(1700000000, 0)
+	if err := pushInflux(sink.Client(), sink.URL+"/write?db=proxy", "test-host", now); err != nil {
+		t.Fatal(err)
+	}
+	line := <-bodies
+	pattern := `^proxy,host=test-host connections=\d+i,active=-?\d+i,blocked=\d+i,bytes_in=\d+i,bytes_out=\d+i 1700000000000000000\n$`
+	if !regexp.MustCompile(pattern).MatchString(line) {
+		t.Errorf("line %q doesn't match %s", line, pattern)
+	}
+}
+
+func TestInfluxLineEscapesHost(t *testing.T) {
+	line := influxLine("a b,c=d", time.Unix(1700000000, 0))
+	if !strings.HasPrefix(line, `proxy,host=a\ b\,c\=d connections=`) {
+		t.Errorf("host tag not escaped: %q", line)
+	}
+}
+
+func TestCheckIntervals(t *testing.T) {
+	if err := checkIntervals(); err != nil {
+		t.Errorf("defaults rejected: %v", err)
+	}
+	for _, name := range []string{"influx-interval", "otel-interval", "breaker-window"} {
+		for _, value := range []string{"0", "-1s"} {
+			setFlag(t, name, value)
+			if err := checkIntervals(); err == nil || !strings.Contains(err.Error(), "-"+name) {
+				t.Errorf("-%s %s: err = %v", name, value, err)
+			}
+		}
+		setFlag(t, name, "1s")
+	}
+}
+
+func TestPushInfluxError(t *testing.T) {
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database not found", http.StatusNotFound)
+	}))
+	defer sink.Close()
+	if err := pushInflux(sink.Client(), sink.URL, "h", time.Now()); err == nil {
+		t.Error("push to a failing sink succeeded")
+	}
+}
+
+// proxyVars returns the "proxy" expvar counters.
+func proxyVars(t *testing.T) map[string]int64 {
+	t.Helper()
+	var counters map[string]int64
+	if err := json.Unmarshal([]byte(expvar.Get("proxy").String()), &counters); err != nil {
+		t.Fatal(err)
+	}
+	return counters
+}
+
+func TestExpvarCounters(t *testing.T) {
+	useBlacklist(t, "bad.example")
+	proxy := startProxy(t, handleClientConnection)
+	before := proxyVars(t)
+
+	conn, _, _ := connect(t, proxy, startEcho(t))
+	conn.Close()
+	conn, _, _ = connect(t, proxy, "bad.example:443")
+	conn.Close()
+	for deadline := time.Now().Add(2 * time.Second); proxyVars(t)["active"] != before["active"] && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	after := proxyVars(t)
+	if after["connections"]-before["connections"] != 2 {
+		t.Errorf("connections %d -> %d, want 2 more", before["connections"], after["connections"])
+	}
+	if after["blocked"]-before["blocked"] != 1 {
+		t.Errorf("blocked %d -> %d, want 1 more", before["blocked"], after["blocked"])
+	}
+
+	rec := adminRequest(t, "GET", "/debug/vars", "")
+	if !strings.Contains(rec.Body.String(), `"proxy": {`) {
+		t.Errorf("/debug/vars lacks the proxy counters: %s", rec.Body)
+	}
+}
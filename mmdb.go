@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata map at the end of a MaxMind DB.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbReader looks up IP addresses in a MaxMind DB file, such as GeoLite2
+// Country or ASN. It implements the subset of the format the proxy needs,
+// see https://maxmind.github.io/MaxMind-DB/.
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  int  // offset of the data section
+	ipv4Start  uint // node at which IPv4 lookups start in an IPv6 tree
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	metaStart := i + len(mmdbMetadataMarker)
+	meta, _, err := mmdbDecode(buf[metaStart:], 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %w", path, err)
+	}
+	fields, ok := meta.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: metadata is not a map", path)
+	}
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  mmdbUint(fields["node_count"]),
+		recordSize: mmdbUint(fields["record_size"]),
+		ipVersion:  mmdbUint(fields["ip_version"]),
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, r.recordSize)
+	}
+	treeSize := int(r.nodeCount * r.recordSize / 4)
+	r.dataStart = treeSize + 16
+	if r.dataStart > i {
+		return nil, fmt.Errorf("%s: search tree exceeds file", path)
+	}
+
+	if r.ipVersion == 6 {
+		// IPv4 addresses live under ::/96
+		node := uint(0)
+		for n := 0; n < 96 && node < r.nodeCount; n++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default: // 32
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record for ip, or nil if the database has none.
+func (r *mmdbReader) lookup(ip net.IP) (any, error) {
+	addr := ip.To4()
+	node := uint(0)
+	switch {
+	case addr != nil && r.ipVersion == 6:
+		node = r.ipv4Start
+	case addr == nil && r.ipVersion == 4:
+		return nil, nil // an IPv4 database knows no IPv6 addresses
+	case addr == nil:
+		addr = ip.To16()
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-i%8)) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+	offset := int(node-r.nodeCount) - 16
+	if offset < 0 || r.dataStart+offset >= len(r.buf) {
+		return nil, errors.New("invalid data pointer in search tree")
+	}
+	value, _, err := mmdbDecode(r.buf[r.dataStart:], offset)
+	return value, err
+}
+
+// mmdbDecode decodes the value at offset in section, where pointers are
+// relative to the section's start, and returns it with the offset after it.
+func mmdbDecode(section []byte, offset int) (any, int, error) {
+	return mmdbDecodeDepth(section, offset, 0)
+}
+
+func mmdbDecodeDepth(section []byte, offset, depth int) (any, int, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	next := func(n int) ([]byte, error) {
+		if n < 0 || offset+n > len(section) {
+			return nil, errors.New("data section truncated")
+		}
+		b := section[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	typ := int(ctrl >> 5)
+
+	if typ == 1 { // pointer
+		ss, vvv := int(ctrl>>3)&3, int(ctrl&7)
+		b, err := next(ss + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr int
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | int(b[0])
+		case 1:
+			ptr = (vvv<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		case 3:
+			ptr = int(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := mmdbDecodeDepth(section, ptr, depth+1)
+		return value, offset, err
+	}
+
+	if typ == 0 { // extended type
+		b, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + int(b[0])
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch size {
+		case 29:
+			size = 29 + int(b[0])
+		case 30:
+			size = 285 + (int(b[0])<<8 | int(b[1]))
+		default:
+			size = 65821 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		}
+	}
+
+	switch typ {
+	case 2: // UTF-8 string
+		b, err := next(size)
+		return string(b), offset, err
+	case 3: // double
+		b, err := next(8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4, 10: // bytes, uint128
+		b, err := next(size)
+		return b, offset, err
+	case 5, 6, 9: // uint16, uint32, uint64
+		if size > 8 {
+			return nil, 0, errors.New("unsigned integer too large")
+		}
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, errors.New("int32 too large")
+		}
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			key, n, err := mmdbDecodeDepth(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, n, err := mmdbDecodeDepth(section, n, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset = n
+			if k, ok := key.(string); ok {
+				m[k] = value
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for range size {
+			value, n, err := mmdbDecodeDepth(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset = n
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	case 15: // float
+		b, err := next(4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	default: // data cache container, end marker
+		return nil, 0, fmt.Errorf("unexpected data type %d", typ)
+	}
+}
+
+// mmdbUint returns a decoded unsigned integer, or 0.
+func mmdbUint(v any) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
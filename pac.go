@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	pacPath            = flag.String("pac-path", "", "serve a proxy auto-config script for GET requests to this path, e.g. /proxy.pac")
+	pacProxy           = flag.String("pac-proxy", "", "proxy host:port written into the PAC script (default: the Host the client used)")
+	pacDirectBlacklist = flag.Bool("pac-direct-blacklist", false, "send blacklisted hosts DIRECT in the PAC script")
+)
+
+// renderPAC returns a PAC script that sends everything except plain and local
+// hosts (and optionally the direct entries) through proxyAddr. A proxy
+// serving TLS is named with HTTPS so browsers speak TLS to it.
+func renderPAC(proxyAddr string, useTLS bool, direct []string) string {
+	list, _ := json.Marshal(direct)
+	keyword := "PROXY "
+	if useTLS {
+		keyword = "HTTPS "
+	}
+	target, _ := json.Marshal(keyword + proxyAddr)
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  if (isPlainHostName(host) || host === \"localhost\" || host === \"127.0.0.1\") {\n")
+	b.WriteString("    return \"DIRECT\";\n")
+	b.WriteString("  }\n")
+	fmt.Fprintf(&b, "  var direct = %s;\n", list)
+	b.WriteString("  for (var i = 0; i < direct.length; i++) {\n")
+	b.WriteString("    if (host.indexOf(direct[i]) === 0) {\n")
+	b.WriteString("      return \"DIRECT\";\n")
+	b.WriteString("    }\n")
+	b.WriteString("  }\n")
+	fmt.Fprintf(&b, "  return %s;\n", target)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// servePAC writes the PAC script for the current config as the response to req.
+func servePAC(client net.Conn, req *http.Request) {
+	proxyAddr := *pacProxy
+	if proxyAddr == "" {
+		proxyAddr = req.Host
+	}
+
+	direct := []string{}
+	if *pacDirectBlacklist {
+		for entry := range currentBlacklist() {
+			// entries are host:port prefixes; PAC only sees the host
+			direct = append(direct, strings.SplitN(entry, ":", 2)[0])
+		}
+		sort.Strings(direct)
+	}
+
+	script := renderPAC(proxyAddr, *tlsCert != "", direct)
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/x-ns-proxy-autoconfig"}},
+		ContentLength: int64(len(script)),
+		Body:          io.NopCloser(strings.NewReader(script)),
+		Close:         true,
+	}
+	resp.Write(client)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServePAC(t *testing.T) {
+	setFlag(t, "pac-path", "/proxy.pac")
+	setFlag(t, "pac-proxy", "")
+	proxy := startProxy(t, handleClientConnection)
+
+	resp := sendRaw(t, proxy, "GET /proxy.pac HTTP/1.1\r\nHost: proxy.lan:10000\r\n\r\n")
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") {
+		t.Fatalf("response: %q", resp)
+	}
+	if !strings.Contains(resp, "application/x-ns-proxy-autoconfig") {
+		t.Errorf("no PAC content type: %q", resp)
+	}
+	if !strings.Contains(resp, `return "PROXY proxy.lan:10000";`) {
+		t.Errorf("script doesn't use the Host the client used: %q", resp)
+	}
+
+	setFlag(t, "pac-proxy", "10.0.0.5:3128")
+	resp = sendRaw(t, proxy, "GET /proxy.pac HTTP/1.1\r\nHost: proxy.lan:10000\r\n\r\n")
+	if !strings.Contains(resp, `return "PROXY 10.0.0.5:3128";`) {
+		t.Errorf("script doesn't use -pac-proxy: %q", resp)
+	}
+}
+
+func TestRenderPACDirect(t *testing.T) {
+	script := renderPAC("proxy:1", false, []string{"ads.example"})
+	if !strings.Contains(script, `var direct = ["ads.example"];`) {
+		t.Errorf("direct list missing: %s", script)
+	}
+	if !strings.HasPrefix(script, "function FindProxyForURL(url, host) {") {
+		t.Errorf("not a PAC function: %s", script)
+	}
+}
+
+func TestServePACOverTLS(t *testing.T) {
+	certFile, keyFile, pair := writeCert(t, t.TempDir(), "proxy")
+	setFlag(t, "tls-cert", certFile)
+	setFlag(t, "tls-key", keyFile)
+	setFlag(t, "pac-path", "/proxy.pac")
+	setFlag(t, "pac-proxy", "")
+	proxy, _ := startTLSProxy(t)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pair.Leaf)
+	conn, err := tls.Dial("tcp", proxy, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /proxy.pac HTTP/1.1\r\nHost: proxy.lan:10000\r\n\r\n")
+	resp, _ := io.ReadAll(conn)
+	if !strings.Contains(string(resp), `return "HTTPS proxy.lan:10000";`) {
+		t.Errorf("script for a TLS listener doesn't use HTTPS: %q", resp)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+var (
+	pprofAddr        = flag.String("pprof-addr", "", "serve net/http/pprof profiles on this address, e.g. 127.0.0.1:6060")
+	pprofAllowRemote = flag.Bool("pprof-allow-remote", false, "allow -pprof-addr to listen on a non-loopback address")
+)
+
+// startPprof serves the runtime profiles under /debug/pprof/ on addr in the
+// background. Profiles expose sensitive runtime data, so addr must be
+// loopback unless -pprof-allow-remote is set.
+func startPprof(addr string) error {
+	if !*pprofAllowRemote {
+		if err := checkLoopbackAddr(addr); err != nil {
+			return fmt.Errorf("%w; use -pprof-allow-remote to allow it", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	listener, err := listenOn("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("pprof listening on %s", addr)
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("pprof stopped: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestStartPprof(t *testing.T) {
+	if err := startPprof("0.0.0.0:0"); err == nil {
+		t.Error("non-loopback address accepted without -pprof-allow-remote")
+	}
+
+	path := socketPath(t)
+	if err := startPprof("unix:" + path); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	for _, page := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+		resp, err := client.Get("http://pprof" + page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %s", page, resp.Status)
+		}
+	}
+}
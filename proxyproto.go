@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+)
+
+var sendProxyProtocol = flag.String("send-proxy-protocol", "", `prepend a HAProxy PROXY protocol header with the client address to upstream connections: "v1" or "v2"`)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader writes a PROXY protocol header of the given version
+// ("v1" or "v2") describing a connection from src to dst. Addresses that are
+// not both TCP of the same family are sent as UNKNOWN/LOCAL.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+	var srcIP, dstIP net.IP
+	v4 := false
+	if known {
+		srcIP, dstIP = srcTCP.IP, dstTCP.IP
+		if srcIP.To4() != nil && dstIP.To4() != nil {
+			srcIP, dstIP, v4 = srcIP.To4(), dstIP.To4(), true
+		} else if srcIP.To4() != nil || dstIP.To4() != nil {
+			known = false // mixed families
+		}
+	}
+
+	switch version {
+	case "v1":
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcTCP.Port, dstTCP.Port)
+		return err
+
+	case "v2":
+		var buf bytes.Buffer
+		buf.Write(proxyV2Signature)
+		if !known {
+			// version 2, command LOCAL, no address
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		} else {
+			family := byte(0x21) // TCP over IPv6
+			if v4 {
+				family = 0x11 // TCP over IPv4
+			}
+			// version 2, command PROXY
+			buf.Write([]byte{0x21, family})
+			binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+			buf.Write(srcIP)
+			buf.Write(dstIP)
+			binary.Write(&buf, binary.BigEndian, uint16(srcTCP.Port))
+			binary.Write(&buf, binary.BigEndian, uint16(dstTCP.Port))
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWriteProxyHeaderV1(t *testing.T) {
+	tcp := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+	tests := []struct {
+		src, dst net.Addr
+		want     string
+	}{
+		{tcp("192.0.2.1", 56324), tcp("198.51.100.7", 443), "PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\r\n"},
+		{tcp("2001:db8::1", 56324), tcp("2001:db8::2", 443), "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"},
+		{tcp("192.0.2.1", 56324), tcp("2001:db8::2", 443), "PROXY UNKNOWN\r\n"},
+		{&net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}, tcp("198.51.100.7", 443), "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeProxyHeader(&buf, "v1", tt.src, tt.dst); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%v -> %v: %q, want %q", tt.src, tt.dst, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestWriteProxyHeaderV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443}
+	var buf bytes.Buffer
+	if err := writeProxyHeader(&buf, "v2", src, dst); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 0x0c, // PROXY, TCP over IPv4, 12 address bytes
+		192, 0, 2, 1, 198, 51, 100, 7,
+		0xdc, 0x04, 0x01, 0xbb) // ports 56324 and 443
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("v2 header\n% x\nwant\n% x", buf.Bytes(), want)
+	}
+
+	buf.Reset()
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}
+	writeProxyHeader(&buf, "v2", src6, dst6)
+	if b := buf.Bytes(); len(b) != 16+36 || b[13] != 0x21 || b[15] != 36 {
+		t.Errorf("v2 IPv6 header % x", b)
+	}
+
+	buf.Reset()
+	writeProxyHeader(&buf, "v2", &net.UnixAddr{Name: "@", Net: "unix"}, dst)
+	if want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0x00, 0x00); !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("v2 LOCAL header % x", buf.Bytes())
+	}
+}
+
+func TestWriteProxyHeaderUnknownVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeProxyHeader(&buf, "v3", &net.TCPAddr{}, &net.TCPAddr{}); err == nil {
+		t.Error("v3 accepted")
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	setFlag(t, "send-proxy-protocol", "v1")
+	proxy := startProxy(t, handleClientConnection)
+	conn, reader, status := connect(t, proxy, startEcho(t))
+	if status != 200 {
+		t.Fatalf("CONNECT: status %d", status)
+	}
+	// the echo target sends the header back before any tunnel data
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "PROXY TCP4 127.0.0.1 127.0.0.1 ") {
+		t.Errorf("target received %q", line)
+	}
+	if port := strings.Fields(line)[4]; port != portOf(conn.LocalAddr()) {
+		t.Errorf("source port %s, want the client's %s", port, portOf(conn.LocalAddr()))
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	perIPConns = flag.Int("per-ip-conns", 0, "maximum concurrent connections per client IP, 0 for unlimited")
+	perIPRate  = flag.Float64("per-ip-rate", 0, "maximum new connections per second per client IP, 0 for unlimited")
+	perIPBurst = flag.Int("per-ip-burst", 10, "burst size for -per-ip-rate")
+)
+
+// ipIdleTimeout is how long an IP without connections is remembered.
+const ipIdleTimeout = 5 * time.Minute
+
+const ipShardCount = 16
+
+// tokenBucket allows rate events per second with bursts of up to burst.
+// It is not safe for concurrent use; ipShard's mutex guards it.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(rate float64, burst int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type ipEntry struct {
+	conns    int
+	bucket   tokenBucket
+	lastSeen time.Time
+}
+
+type ipShard struct {
+	mu      sync.Mutex
+	entries map[string]*ipEntry
+}
+
+// ipLimiter tracks concurrent connections and connection rate per client IP.
+// The map is sharded so busy clients don't contend on a single lock.
+type ipLimiter struct {
+	maxConns int
+	rate     float64
+	burst    int
+	shards   [ipShardCount]ipShard
+}
+
+// clientLimiter is nil when no per-IP limit is configured.
+var clientLimiter *ipLimiter
+
+func newIPLimiter(maxConns int, perSecond float64, burst int) *ipLimiter {
+	l := &ipLimiter{maxConns: maxConns, rate: perSecond, burst: max(burst, 1)}
+	for i := range l.shards {
+		l.shards[i].entries = make(map[string]*ipEntry)
+	}
+	return l
+}
+
+func (l *ipLimiter) shard(ip string) *ipShard {
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	return &l.shards[h.Sum32()%ipShardCount]
+}
+
+// acquire registers a new connection from ip. It reports false when the
+// connection exceeds the IP's rate or concurrency limit, in which case
+// release must not be called.
+func (l *ipLimiter) acquire(ip string) bool {
+	s := l.shard(ip)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entries[ip]
+	if e == nil {
+		e = &ipEntry{}
+		s.entries[ip] = e
+	}
+	e.lastSeen = time.Now()
+	if l.maxConns > 0 && e.conns >= l.maxConns {
+		return false
+	}
+	if !e.bucket.allow(l.rate, l.burst, e.lastSeen) {
+		return false
+	}
+	e.conns++
+	return true
+}
+
+func (l *ipLimiter) release(ip string) {
+	s := l.shard(ip)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e := s.entries[ip]; e != nil {
+		e.conns--
+		e.lastSeen = time.Now()
+	}
+}
+
+// sweep forgets IPs that have had no connections for longer than idle.
+func (l *ipLimiter) sweep(idle time.Duration) {
+	cutoff := time.Now().Add(-idle)
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mu.Lock()
+		for ip, e := range s.entries {
+			if e.conns == 0 && e.lastSeen.Before(cutoff) {
+				delete(s.entries, ip)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sweepLoop periodically forgets idle IPs. It never returns.
+func (l *ipLimiter) sweepLoop() {
+	for range time.Tick(ipIdleTimeout) {
+		l.sweep(ipIdleTimeout)
+	}
+}
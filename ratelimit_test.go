@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if !b.allow(1, 3, now) {
+			t.Fatalf("event %d of a burst of 3 refused", i+1)
+		}
+	}
+	if b.allow(1, 3, now) {
+		t.Error("fourth event in the same instant allowed")
+	}
+	if b.allow(1, 3, now.Add(500*time.Millisecond)) {
+		t.Error("allowed before a token refilled")
+	}
+	if !b.allow(1, 3, now.Add(1500*time.Millisecond)) {
+		t.Error("refused after a token refilled")
+	}
+	// refilling stops at the burst size
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.allow(1, 3, later)
+	}
+	if b.allow(1, 3, later) {
+		t.Error("bucket refilled past its burst size")
+	}
+}
+
+func TestIPLimiterConns(t *testing.T) {
+	l := newIPLimiter(2, 0, 0)
+	if !l.acquire("10.0.0.1") || !l.acquire("10.0.0.1") {
+		t.Fatal("connections under the limit refused")
+	}
+	if l.acquire("10.0.0.1") {
+		t.Error("third concurrent connection allowed")
+	}
+	if !l.acquire("10.0.0.2") {
+		t.Error("another IP shares the limit")
+	}
+	l.release("10.0.0.1")
+	if !l.acquire("10.0.0.1") {
+		t.Error("connection refused after a release")
+	}
+}
+
+func TestIPLimiterRate(t *testing.T) {
+	l := newIPLimiter(0, 0.001, 2)
+	l.acquire("10.0.0.1")
+	l.acquire("10.0.0.1")
+	if l.acquire("10.0.0.1") {
+		t.Error("connection over the burst allowed")
+	}
+	// releasing a connection gives no token back
+	l.release("10.0.0.1")
+	if l.acquire("10.0.0.1") {
+		t.Error("release refilled the rate limit")
+	}
+}
+
+func TestIPLimiterSweep(t *testing.T) {
+	l := newIPLimiter(1, 0, 0)
+	l.acquire("10.0.0.1")
+	l.acquire("10.0.0.2")
+	l.release("10.0.0.2")
+
+	l.sweep(0)
+	if s := l.shard("10.0.0.2"); s.entries["10.0.0.2"] != nil {
+		t.Error("idle IP not forgotten")
+	}
+	if s := l.shard("10.0.0.1"); s.entries["10.0.0.1"] == nil {
+		t.Error("IP with an open connection forgotten")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr, want string
+	}{
+		{"10.0.0.1:5555", "10.0.0.1"},
+		{"[2001:db8::1]:5555", "2001:db8::1"},
+		{"[2001:db8::1]:5556", "2001:db8::1"},
+		{"[::ffff:10.0.0.1]:5555", "10.0.0.1"},
+		{"[::1]:5555", "::1"},
+		{"/run/proxy.sock", "/run/proxy.sock"},
+	}
+	for _, tt := range tests {
+		if got := clientIP(tt.remoteAddr); got != tt.want {
+			t.Errorf("clientIP(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestPerIPConnsIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	clientLimiter = newIPLimiter(1, 0, 0)
+	t.Cleanup(func() { clientLimiter = nil })
+	go serve(listener, handleClientConnection)
+	t.Cleanup(func() {
+		listener.Close()
+		handlers.Wait()
+	})
+	proxy := listener.Addr().String()
+
+	// each connection comes from a new source port of the same IP
+	first, _, status := connect(t, proxy, startEcho(t))
+	if status != http.StatusOK {
+		t.Fatalf("first CONNECT: status %d", status)
+	}
+	defer first.Close()
+	if _, _, status := connect(t, proxy, startEcho(t)); status != http.StatusTooManyRequests {
+		t.Errorf("second CONNECT from ::1 with -per-ip-conns 1: status %d, want 429", status)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// liveListener holds the proxy listener, which a config reload may replace
+// with one on a new address. Connections accepted on the old listener are
+// not affected by the switch.
+type liveListener struct {
+	mu       sync.Mutex
+	addr     string
+	listener net.Listener
+	wrap     func(net.Listener) net.Listener // e.g. TLS; nil for none
+	closed   bool
+
+	replaced chan net.Listener
+}
+
+func newLiveListener(addr string, listener net.Listener, wrap func(net.Listener) net.Listener) *liveListener {
+	return &liveListener{addr: addr, listener: listener, wrap: wrap, replaced: make(chan net.Listener, 1)}
+}
+
+// close closes the current listener for good.
+func (l *liveListener) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.listener.Close()
+}
+
+// rebind moves the listener to addr unless it is already there. The old
+// listener is only closed once the new one is bound.
+func (l *liveListener) rebind(addr string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || addr == l.addr {
+		return nil
+	}
+	listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	if l.wrap != nil {
+		listener = l.wrap(listener)
+	}
+	l.replaced <- listener
+	old := l.listener
+	l.listener, l.addr = listener, addr
+	old.Close()
+	return nil
+}
+
+// serve runs serve on the listener and, after each rebind, on its
+// replacement. It returns once the listener is closed for good.
+func (l *liveListener) serve(handle func(net.Conn)) error {
+	l.mu.Lock()
+	listener := l.listener
+	l.mu.Unlock()
+	for {
+		if err := serve(listener, handle); err != nil {
+			return err
+		}
+		select {
+		case listener = <-l.replaced:
+			log.Printf("Listening on %s", listener.Addr())
+		default:
+			return nil
+		}
+	}
+}
+
+// reloadListenOnHUP re-reads the listen address from the config file at path
+// on every SIGHUP and moves l there if it changed.
+func reloadListenOnHUP(path string, l *liveListener) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for range reload {
+		addr, err := configString(path, "listen")
+		if err != nil {
+			log.Printf("Error reloading %s: %v", path, err)
+			continue
+		}
+		if addr == "" {
+			addr = defaultListenAddr
+		}
+		if err := l.rebind(addr); err != nil {
+			log.Printf("Error moving listener to %s, keeping the old one: %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// greet dials addr and returns what the server sends before closing.
+func greet(addr string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(conn)
+	return string(b), err
+}
+
+func TestLiveListenerRebind(t *testing.T) {
+	oldAddr := freeAddr(t)
+	listener, err := net.Listen("tcp", oldAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLiveListener(oldAddr, listener, nil)
+	served := make(chan error, 1)
+	go func() {
+		served <- l.serve(func(conn net.Conn) {
+			io.WriteString(conn, "hi")
+			conn.Close()
+		})
+	}()
+	if got, err := greet(oldAddr); got != "hi" {
+		t.Fatalf("before rebind: %q, %v", got, err)
+	}
+
+	if err := l.rebind(oldAddr); err != nil {
+		t.Errorf("rebind to the current address: %v", err)
+	}
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	if err := l.rebind(busy.Addr().String()); err == nil {
+		t.Error("rebind to an address in use succeeded")
+	}
+	if got, err := greet(oldAddr); got != "hi" {
+		t.Errorf("after a failed rebind: %q, %v", got, err)
+	}
+
+	newAddr := freeAddr(t)
+	if err := l.rebind(newAddr); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := greet(newAddr); got != "hi" {
+		t.Errorf("new address: %q, %v", got, err)
+	}
+	if _, err := net.DialTimeout("tcp", oldAddr, time.Second); err == nil {
+		t.Error("old address still accepts connections")
+	}
+
+	l.close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve = %v after close", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve did not return after close")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var rewriteSpec = flag.String("rewrite", "", `comma-separated target rewrites "pattern=host[:port]", e.g. "*.ads.example=127.0.0.1:8080"; tunnels to matching hosts dial the replacement instead (patterns as in -rules)`)
+
+// targetRewrite redirects dials to hosts matching its rule to replacement.
+type targetRewrite struct {
+	rule        routeRule
+	replacement string
+}
+
+// rewrites holds the parsed -rewrite list in order; the first match wins.
+var rewrites []targetRewrite
+
+// parseRewrites parses a -rewrite list.
+func parseRewrites(spec string) ([]targetRewrite, error) {
+	var list []targetRewrite
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, replacement, ok := strings.Cut(item, "=")
+		if !ok || pattern == "" || replacement == "" {
+			return nil, fmt.Errorf("invalid rewrite %q, want pattern=host[:port]", item)
+		}
+		rule := routeRule{pattern: strings.ToLower(pattern)}
+		if strings.Contains(rule.pattern, "/") {
+			if _, _, err := net.ParseCIDR(rule.pattern); err != nil {
+				return nil, err
+			}
+		}
+		list = append(list, targetRewrite{rule: rule, replacement: replacement})
+	}
+	return list, nil
+}
+
+// rewriteTarget returns the address to dial for hostPort: the replacement of
+// the first matching rewrite, keeping hostPort's port if the replacement has
+// none, or hostPort itself.
+func rewriteTarget(hostPort string) string {
+	for _, r := range rewrites {
+		if !r.rule.matches(hostPort) {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(r.replacement); err == nil {
+			return r.replacement
+		}
+		_, port, _ := net.SplitHostPort(hostPort)
+		return withDefaultPort(r.replacement, port)
+	}
+	return hostPort
+}
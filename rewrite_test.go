@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseRewrites(t *testing.T) {
+	list, err := parseRewrites(" *.ads.example=127.0.0.1:8080, Old.Example=new.example ,10.0.0.0/8=gw.example,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("%d rewrites, want 3", len(list))
+	}
+	if list[1].rule.pattern != "old.example" || list[1].replacement != "new.example" {
+		t.Errorf("rewrite %+v, want a lower-case pattern", list[1])
+	}
+	for _, bad := range []string{"example.com", "=x.example", "x.example=", "10.0.0.0/33=x.example"} {
+		if _, err := parseRewrites(bad); err == nil {
+			t.Errorf("parseRewrites(%q) accepted", bad)
+		}
+	}
+}
+
+func TestRewriteTarget(t *testing.T) {
+	useRewrites(t, "*.ads.example=127.0.0.1:8080,old.example=new.example,*=last.example:1")
+	tests := []struct {
+		hostPort, want string
+	}{
+		{"x.ads.example:443", "127.0.0.1:8080"},
+		// a replacement without a port keeps the target's
+		{"old.example:8443", "new.example:8443"},
+		// the first match wins
+		{"other.example:443", "last.example:1"},
+	}
+	for _, tt := range tests {
+		if got := rewriteTarget(tt.hostPort); got != tt.want {
+			t.Errorf("rewriteTarget(%q) = %q, want %q", tt.hostPort, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteIsExemptFromBlockPrivate(t *testing.T) {
+	setFlag(t, "block-private", "true")
+	useRewrites(t, "local.test="+startEcho(t))
+
+	conn, err := dialTarget(context.Background(), "local.test:443")
+	if err != nil {
+		t.Fatalf("rewritten dial to loopback refused: %v", err)
+	}
+	conn.Close()
+	if _, blocked := checkPolicy("local.test:443"); blocked {
+		t.Error("-check reports a rewritten target as blocked")
+	}
+	// without a rewrite the same address is refused
+	useRewrites(t, "")
+	if _, err := dialTarget(context.Background(), startEcho(t)); err == nil {
+		t.Error("dial to loopback allowed with -block-private")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var rulesPath = flag.String("rules", "", "routing rules file; each line is a host pattern and an action: direct, block, or an upstream proxy URL (socks5://, socks5s://, http://, https://)")
+
+// Route actions besides an upstream proxy URL.
+const (
+	routeDirect = "direct"
+	routeBlock  = "block"
+)
+
+// routeRule sends connections to hosts matching pattern to upstream, or
+// handles them per action when upstream is nil.
+type routeRule struct {
+	pattern  string
+	action   string
+	upstream *url.URL
+}
+
+// routes holds the rules from -rules in file order; the first match wins.
+var routes []routeRule
+
+// loadRules parses a rules file. Everything after a '#' is a comment and
+// blank lines are ignored. Patterns are "*" for every host, an exact host or
+// IP, "*.example.com" for subdomains of example.com, or a CIDR such as
+// "10.0.0.0/8" for IP targets.
+func loadRules(filename string) ([]routeRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []routeRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"pattern action\"", filename, lineNo)
+		}
+		rule := routeRule{pattern: strings.ToLower(fields[0]), action: fields[1]}
+		if strings.Contains(rule.pattern, "/") {
+			if _, _, err := net.ParseCIDR(rule.pattern); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+			}
+		}
+		switch rule.action {
+		case routeDirect, routeBlock:
+		default:
+			upstream, err := url.Parse(rule.action)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+			}
+			switch upstream.Scheme {
+			case "socks", "socks5", "socks5s", "http", "https":
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown action %q", filename, lineNo, rule.action)
+			}
+			rule.upstream = upstream
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// matches reports whether hostPort's host matches the rule's pattern.
+func (r *routeRule) matches(hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	switch {
+	case r.pattern == "*":
+		return true
+	case strings.HasPrefix(r.pattern, "*."):
+		return strings.HasSuffix(host, r.pattern[1:])
+	case strings.Contains(r.pattern, "/"):
+		_, network, _ := net.ParseCIDR(r.pattern)
+		ip := net.ParseIP(host)
+		return ip != nil && network.Contains(ip)
+	default:
+		return host == r.pattern
+	}
+}
+
+// matchRoute returns the first rule matching hostPort, or nil.
+func matchRoute(hostPort string) *routeRule {
+	for i := range routes {
+		if routes[i].matches(hostPort) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// matchBlock returns the rule blocking hostPort: a blacklist entry or a
+// "block" route.
+func matchBlock(hostPort string) (string, bool) {
+	if rule, blocked := matchBlacklist(hostPort); blocked {
+		return rule, true
+	}
+	if route := matchRoute(hostPort); route != nil && route.action == routeBlock {
+		return route.pattern, true
+	}
+	return "", false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// schedule is a weekly time window during which a blacklist entry applies.
+// Times are minutes since midnight in local time; a window whose end is
+// before its start runs past midnight into the next day.
+type schedule struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseBlacklistLine splits a blacklist line into its host prefix and an
+// optional schedule, e.g. "example.com @mon-fri 09:00-17:00". Entries
+// without a schedule have a nil schedule and always apply.
+func parseBlacklistLine(line string) (string, *schedule, error) {
+	entry, spec, ok := strings.Cut(line, "@")
+	entry = strings.TrimSpace(entry)
+	if !ok {
+		return entry, nil, nil
+	}
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return "", nil, fmt.Errorf("%q: %v", line, err)
+	}
+	return entry, sched, nil
+}
+
+// parseSchedule parses "[days] [HH:MM-HH:MM]" where days is a comma-separated
+// list of weekdays or ranges such as "mon-fri,sun". Days default to every day
+// and the time to the whole day.
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) > 0 && !strings.Contains(fields[len(fields)-1], ":") {
+		fields = append(fields, "00:00-24:00")
+	}
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("want @[days] [HH:MM-HH:MM]")
+	}
+	s := &schedule{}
+	if len(fields) == 1 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	} else if err := s.parseDays(fields[0]); err != nil {
+		return nil, err
+	}
+
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return nil, fmt.Errorf("bad time range %q", fields[len(fields)-1])
+	}
+	var err error
+	if s.start, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if s.end, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	if s.start == s.end {
+		return nil, fmt.Errorf("empty time range %q", fields[len(fields)-1])
+	}
+	return s, nil
+}
+
+func (s *schedule) parseDays(spec string) error {
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[from]
+		if !ok {
+			return fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[to]; !ok {
+				return fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			s.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight; "24:00" is allowed
+// as the end of the day.
+func parseClock(clock string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hour, &minute); err != nil || len(clock) != 5 {
+		return 0, fmt.Errorf("bad time %q", clock)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || hour == 24 && minute != 0 {
+		return 0, fmt.Errorf("bad time %q", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+// active reports whether t falls inside the schedule. A nil schedule is
+// always active.
+func (s *schedule) active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	day, minute := t.Weekday(), t.Hour()*60+t.Minute()
+	if s.start < s.end {
+		return s.days[day] && minute >= s.start && minute < s.end
+	}
+	// past midnight: the window belongs to the day it started on
+	yesterday := (day + 6) % 7
+	return s.days[day] && minute >= s.start || s.days[yesterday] && minute < s.end
+}
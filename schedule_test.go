@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// weekdayAt returns the given weekday of the week of 2024-01-01, a Monday, at hh:mm.
+func weekdayAt(day time.Weekday, hh, mm int) time.Time {
+	return time.Date(2024, 1, 1+(int(day)+6)%7, hh, mm, 0, 0, time.Local)
+}
+
+func TestScheduleActive(t *testing.T) {
+	tests := []struct {
+		spec string
+		at   time.Time
+		want bool
+	}{
+		{"mon-fri 09:00-17:00", weekdayAt(time.Monday, 9, 0), true},
+		{"mon-fri 09:00-17:00", weekdayAt(time.Friday, 16, 59), true},
+		{"mon-fri 09:00-17:00", weekdayAt(time.Friday, 17, 0), false},
+		{"mon-fri 09:00-17:00", weekdayAt(time.Saturday, 12, 0), false},
+		{"sat,sun", weekdayAt(time.Sunday, 23, 59), true},
+		{"sat,sun", weekdayAt(time.Monday, 0, 0), false},
+		{"fri-mon", weekdayAt(time.Sunday, 12, 0), true},
+		{"fri-mon", weekdayAt(time.Wednesday, 12, 0), false},
+		{"12:00-24:00", weekdayAt(time.Tuesday, 23, 59), true},
+		{"12:00-24:00", weekdayAt(time.Tuesday, 11, 59), false},
+		// a window past midnight belongs to the day it started on
+		{"fri 22:00-02:00", weekdayAt(time.Friday, 23, 0), true},
+		{"fri 22:00-02:00", weekdayAt(time.Saturday, 1, 59), true},
+		{"fri 22:00-02:00", weekdayAt(time.Saturday, 2, 0), false},
+		{"fri 22:00-02:00", weekdayAt(time.Friday, 1, 0), false},
+		{"fri 22:00-02:00", weekdayAt(time.Saturday, 23, 0), false},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("parseSchedule(%q): %v", tt.spec, err)
+		}
+		if got := s.active(tt.at); got != tt.want {
+			t.Errorf("%q active at %s = %v, want %v", tt.spec, tt.at.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+
+	var always *schedule
+	if !always.active(weekdayAt(time.Monday, 3, 0)) {
+		t.Error("nil schedule inactive")
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"mon 09:00-17:00 extra",
+		"funday",
+		"mon-funday 09:00-17:00",
+		"mon 0900-1700",
+		"mon 9:00-17:00",
+		"mon 09:00-24:01",
+		"mon 09:60-17:00",
+		"mon 09:00-09:00",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) accepted", spec)
+		}
+	}
+}
+
+func TestParseBlacklistLine(t *testing.T) {
+	entry, sched, err := parseBlacklistLine("example.com")
+	if entry != "example.com" || sched != nil || err != nil {
+		t.Errorf("plain entry: %q, %v, %v", entry, sched, err)
+	}
+
+	entry, sched, err = parseBlacklistLine("games.example @ mon-fri 09:00-17:00")
+	if err != nil || entry != "games.example" || sched == nil {
+		t.Fatalf("scheduled entry: %q, %v, %v", entry, sched, err)
+	}
+	if !sched.active(weekdayAt(time.Wednesday, 10, 0)) || sched.active(weekdayAt(time.Sunday, 10, 0)) {
+		t.Errorf("schedule = %+v", *sched)
+	}
+
+	if _, _, err := parseBlacklistLine("example.com @someday"); err == nil {
+		t.Error("bad schedule accepted")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socksVersion        = 5
+	socksAuthNone       = 0
+	socksAuthPassword   = 2
+	socksCmdConnect     = 1
+	socksAddrIPv4       = 1
+	socksAddrDomain     = 3
+	socksAddrIPv6       = 4
+	socksReplySucceeded = 0
+)
+
+// dialViaSOCKS opens a tunnel to hostPort through the SOCKS5 proxy at
+// proxyURL, authenticating with the URL's user info if present. A socks5s://
+// proxy is spoken to over TLS.
+func dialViaSOCKS(ctx context.Context, proxyURL *url.URL, hostPort string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	ctx, cancel := withDialTimeout(ctx)
+	defer cancel()
+	raw, err := dialDirect(ctx, withDefaultPort(proxyURL.Host, "1080"))
+	if err != nil {
+		return nil, err
+	}
+	conn := raw
+	err = upstreamHandshake(ctx, raw, func() error {
+		if proxyURL.Scheme == "socks5s" {
+			tlsConn := tls.Client(raw, upstreamTLSConfig(proxyURL))
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return err
+			}
+			conn = tlsConn
+		}
+		return socksConnect(conn, proxyURL.User, host, uint16(port))
+	})
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("upstream proxy %s: %w", proxyURL.Host, err)
+	}
+	return conn, nil
+}
+
+// socksConnect performs the SOCKS5 handshake and CONNECT request on conn.
+func socksConnect(conn net.Conn, user *url.Userinfo, host string, port uint16) error {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = []byte{socksAuthNone, socksAuthPassword}
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return errors.New("SOCKS proxy requires a username and password")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("SOCKS username or password too long")
+		}
+		auth := []byte{1, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS authentication failed")
+		}
+	default:
+		return errors.New("SOCKS proxy accepts none of our authentication methods")
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long for SOCKS")
+		}
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// version(1) reply(1) reserved(1) address type(1), then the bound address
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socksReplySucceeded {
+		return fmt.Errorf("SOCKS connect failed with reply %d", header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case socksAddrIPv4:
+		addrLen = net.IPv4len
+	case socksAddrIPv6:
+		addrLen = net.IPv6len
+	case socksAddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		addrLen = int(n[0])
+	default:
+		return fmt.Errorf("unknown SOCKS address type %d", header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
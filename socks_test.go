@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+)
+
+// startSOCKSServer runs a stub SOCKS5 server that requires password as the
+// password of user "user" if set, sends each CONNECT target on targets and
+// then echoes the tunnel. A non-nil config serves it over TLS.
+func startSOCKSServer(t *testing.T, password string, config *tls.Config) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	t.Cleanup(func() { listener.Close() })
+	targets := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if target, err := socksServe(conn, password); err == nil {
+					targets <- target
+					io.Copy(conn, conn)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+// socksServe answers a SOCKS5 handshake and CONNECT request on conn and
+// returns the requested target.
+func socksServe(conn net.Conn, password string) (string, error) {
+	r := bufio.NewReader(conn)
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(r, greeting); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, make([]byte, greeting[1])); err != nil {
+		return "", err
+	}
+	if password == "" {
+		conn.Write([]byte{socksVersion, socksAuthNone})
+	} else {
+		conn.Write([]byte{socksVersion, socksAuthPassword})
+		// version(1) ulen(1) user plen(1) password
+		head := make([]byte, 2)
+		io.ReadFull(r, head)
+		user := make([]byte, head[1])
+		io.ReadFull(r, user)
+		plen, _ := r.ReadByte()
+		pass := make([]byte, plen)
+		io.ReadFull(r, pass)
+		if string(user) != "user" || string(pass) != password {
+			conn.Write([]byte{1, 1})
+			return "", fmt.Errorf("bad credentials")
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	var host string
+	switch header[3] {
+	case socksAddrDomain:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(r, name)
+		host = string(name)
+	case socksAddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case socksAddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{socksVersion, socksReplySucceeded, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port))), nil
+}
+
+// echoes checks that conn relays data both ways.
+func echoes(t *testing.T, conn net.Conn) {
+	t.Helper()
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("tunnel: %q, %v", buf, err)
+	}
+}
+
+func TestDialViaSOCKS(t *testing.T) {
+	addr, targets := startSOCKSServer(t, "secret", nil)
+
+	proxyURL := &url.URL{Scheme: "socks5", Host: addr, User: url.UserPassword("user", "secret")}
+	conn, err := dialViaSOCKS(context.Background(), proxyURL, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := <-targets; target != "example.com:443" {
+		t.Errorf("SOCKS server asked for %s", target)
+	}
+	echoes(t, conn)
+
+	conn, err = dialViaSOCKS(context.Background(), proxyURL, "[2001:db8::1]:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if target := <-targets; target != "[2001:db8::1]:8443" {
+		t.Errorf("SOCKS server asked for %s", target)
+	}
+
+	proxyURL.User = url.UserPassword("user", "wrong")
+	if _, err := dialViaSOCKS(context.Background(), proxyURL, "example.com:443"); err == nil {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestDialViaSOCKSOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _, pair := writeCert(t, dir, "socks")
+	addr, targets := startSOCKSServer(t, "", &tls.Config{Certificates: []tls.Certificate{pair}})
+	_, port, _ := net.SplitHostPort(addr)
+	// the certificate is for 127.0.0.1; sni overrides the name checked
+	proxyURL, _ := url.Parse("socks5s://localhost:" + port + "?sni=127.0.0.1")
+
+	if _, err := dialViaSOCKS(context.Background(), proxyURL, "example.com:443"); err == nil {
+		t.Fatal("untrusted certificate accepted")
+	}
+
+	pool, err := loadCertPool(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamRootCAs = pool
+	t.Cleanup(func() { upstreamRootCAs = nil })
+	conn, err := dialViaSOCKS(context.Background(), proxyURL, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := <-targets; target != "example.com:443" {
+		t.Errorf("SOCKS server asked for %s", target)
+	}
+	echoes(t, conn)
+}
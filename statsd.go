@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+var (
+	statsdAddr   = flag.String("statsd-addr", "", "send StatsD metrics over UDP to this host:port")
+	statsdPrefix = flag.String("statsd-prefix", "proxy.", "prefix of StatsD metric names")
+)
+
+// statsdPacketSize keeps batched packets below a typical path MTU.
+const statsdPacketSize = 1432
+
+// statsdFlushInterval bounds how long a metric waits in a partial packet.
+const statsdFlushInterval = time.Second
+
+// statsd is nil unless -statsd-addr is set.
+var statsd *statsdClient
+
+// statsdClient batches StatsD lines into UDP packets in the background.
+type statsdClient struct {
+	conn  net.Conn
+	lines chan string
+}
+
+func newStatsdClient(addr string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &statsdClient{conn: conn, lines: make(chan string, 1024)}
+	go c.run()
+	return c, nil
+}
+
+// count queues a counter increment. Metrics are dropped rather than block a
+// handler when the sender falls behind.
+func (c *statsdClient) count(name string, value int64) {
+	c.send(fmt.Sprintf("%s%s:%d|c", *statsdPrefix, name, value))
+}
+
+// timing queues a timer value in milliseconds.
+func (c *statsdClient) timing(name string, d time.Duration) {
+	c.send(fmt.Sprintf("%s%s:%d|ms", *statsdPrefix, name, d.Milliseconds()))
+}
+
+func (c *statsdClient) send(line string) {
+	select {
+	case c.lines <- line:
+	default:
+	}
+}
+
+func (c *statsdClient) run() {
+	packet := make([]byte, 0, statsdPacketSize)
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := c.conn.Write(packet); err != nil {
+			log.Printf("Error sending StatsD metrics: %v", err)
+		}
+		packet = packet[:0]
+	}
+
+	ticker := time.NewTicker(statsdFlushInterval)
+	for {
+		select {
+		case line := <-c.lines:
+			if len(packet)+len(line)+1 > statsdPacketSize {
+				flush()
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
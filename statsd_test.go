@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenStatsd returns a UDP socket standing in for a StatsD server.
+func listenStatsd(t *testing.T) net.PacketConn {
+	t.Helper()
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	server.SetReadDeadline(time.Now().Add(3 * time.Second))
+	return server
+}
+
+func TestStatsdClient(t *testing.T) {
+	setFlag(t, "statsd-prefix", "test.")
+	server := listenStatsd(t)
+	client, err := newStatsdClient(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.count("connections", 1)
+	client.timing("duration", 1500*time.Millisecond)
+
+	buf := make([]byte, statsdPacketSize)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "test.connections:1|c\ntest.duration:1500|ms"; got != want {
+		t.Errorf("packet = %q, want %q", got, want)
+	}
+}
+
+func TestStatsdPacketSize(t *testing.T) {
+	server := listenStatsd(t)
+	client, err := newStatsdClient(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const metrics = 200
+	for i := 0; i < metrics; i++ {
+		client.count("bytes_in", 123456)
+	}
+
+	buf := make([]byte, 64*1024)
+	lines := 0
+	for lines < metrics {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("after %d lines: %v", lines, err)
+		}
+		if n > statsdPacketSize {
+			t.Errorf("packet of %d bytes, want at most %d", n, statsdPacketSize)
+		}
+		lines += len(strings.Split(string(buf[:n]), "\n"))
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"time"
+)
+
+var (
+	tcpKeepAlive = flag.Duration("tcp-keepalive", 30*time.Second, "TCP keep-alive period for tunneled connections, 0 to disable keep-alives")
+	tcpNoDelay   = flag.Bool("tcp-nodelay", true, "disable Nagle's algorithm on tunneled connections")
+)
+
+// tuneTCP applies -tcp-keepalive and -tcp-nodelay to conn if it is, or wraps,
+// a TCP connection. Other connections are left alone.
+func tuneTCP(conn net.Conn) {
+	tcpConn, ok := unwrapConn(conn).(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if *tcpKeepAlive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(*tcpKeepAlive)
+	} else {
+		tcpConn.SetKeepAlive(false)
+	}
+	tcpConn.SetNoDelay(*tcpNoDelay)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// sockopt reads an integer socket option of conn.
+func sockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return value
+}
+
+func TestTuneTCP(t *testing.T) {
+	conn, err := net.Dial("tcp", startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tcpConn := conn.(*net.TCPConn)
+
+	setFlag(t, "tcp-keepalive", "45s")
+	setFlag(t, "tcp-nodelay", "false")
+	// wrappers are looked through
+	tuneTCP(&closeOnceConn{Conn: conn})
+	if sockopt(t, tcpConn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		t.Error("keep-alive off")
+	}
+	if idle := sockopt(t, tcpConn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 45 {
+		t.Errorf("keep-alive idle %ds, want 45s", idle)
+	}
+	if sockopt(t, tcpConn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Error("TCP_NODELAY set with -tcp-nodelay=false")
+	}
+
+	setFlag(t, "tcp-keepalive", "0")
+	setFlag(t, "tcp-nodelay", "true")
+	tuneTCP(conn)
+	if sockopt(t, tcpConn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+		t.Error("keep-alive still on with -tcp-keepalive=0")
+	}
+	if sockopt(t, tcpConn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Error("TCP_NODELAY not set")
+	}
+}
+
+func TestTuneTCPIgnoresOtherConns(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tuneTCP(client) // must not panic
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	tlsCert     = flag.String("tls-cert", "", "serve the proxy over TLS using this certificate file; reloaded on SIGHUP")
+	tlsKey      = flag.String("tls-key", "", "private key file for -tls-cert")
+	tlsClientCA = flag.String("tls-client-ca", "", "require client certificates signed by the CAs in this file")
+	upstreamCA  = flag.String("upstream-ca", "", "verify https:// and socks5s:// upstream proxies against the CAs in this file instead of the system roots")
+)
+
+// upstreamRootCAs holds the -upstream-ca certificates; nil means the system
+// roots.
+var upstreamRootCAs *x509.CertPool
+
+// loadCertPool reads the PEM certificates in path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certReloader serves a certificate pair that can be reloaded from disk
+// without restarting the listener.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// newListenerTLSConfig builds the TLS config for the client-to-proxy hop from
+// the -tls-* flags.
+func newListenerTLSConfig() (*tls.Config, *certReloader, error) {
+	if *tlsKey == "" {
+		return nil, nil, errors.New("-tls-cert requires -tls-key")
+	}
+	reloader := &certReloader{certFile: *tlsCert, keyFile: *tlsKey}
+	if err := reloader.reload(); err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if *tlsClientCA != "" {
+		pool, err := loadCertPool(*tlsClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, reloader, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for 127.0.0.1, usable as its own
+// CA, and its key to dir, and returns the file names and the parsed pair.
+func writeCert(t *testing.T, dir, name string) (certFile, keyFile string, pair tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pair, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, pair
+}
+
+// startTLSProxy serves the proxy over TLS configured from the -tls-* flags.
+func startTLSProxy(t *testing.T) (string, *certReloader) {
+	t.Helper()
+	config, reloader, err := newListenerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(tls.NewListener(listener, config), handleClientConnection)
+	t.Cleanup(func() {
+		listener.Close()
+		handlers.Wait()
+	})
+	return listener.Addr().String(), reloader
+}
+
+// connectTLS sends a CONNECT for target over TLS and returns the status.
+func connectTLS(proxyAddr, target string, config *tls.Config) (int, error) {
+	conn, err := tls.Dial("tcp", proxyAddr, config)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return 0, err
+	}
+	return resp.StatusCode, nil
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeCert(t, dir, "proxy")
+	setFlag(t, "tls-cert", certFile)
+	setFlag(t, "tls-key", keyFile)
+	proxy, reloader := startTLSProxy(t)
+	echo := startEcho(t)
+
+	roots, err := loadCertPool(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := connectTLS(proxy, echo, &tls.Config{RootCAs: roots}); err != nil || status != http.StatusOK {
+		t.Fatalf("CONNECT over TLS: status %d, err %v", status, err)
+	}
+
+	// a reload serves the new certificate to new connections
+	newCert, newKey, _ := writeCert(t, dir, "renewed")
+	reloader.certFile, reloader.keyFile = newCert, newKey
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connectTLS(proxy, echo, &tls.Config{RootCAs: roots}); err == nil {
+		t.Error("old certificate still served after a reload")
+	}
+	newRoots, _ := loadCertPool(newCert)
+	if _, err := connectTLS(proxy, echo, &tls.Config{RootCAs: newRoots}); err != nil {
+		t.Errorf("reloaded certificate: %v", err)
+	}
+}
+
+func TestTLSListenerClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeCert(t, dir, "proxy")
+	caFile, _, clientCert := writeCert(t, dir, "client")
+	setFlag(t, "tls-cert", certFile)
+	setFlag(t, "tls-key", keyFile)
+	setFlag(t, "tls-client-ca", caFile)
+	proxy, _ := startTLSProxy(t)
+	echo := startEcho(t)
+	roots, _ := loadCertPool(certFile)
+
+	if _, err := connectTLS(proxy, echo, &tls.Config{RootCAs: roots}); err == nil {
+		t.Error("client without a certificate accepted")
+	}
+	config := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}
+	if status, err := connectTLS(proxy, echo, config); err != nil || status != http.StatusOK {
+		t.Errorf("client with a certificate: status %d, err %v", status, err)
+	}
+}
+
+func TestNewListenerTLSConfigNeedsKey(t *testing.T) {
+	setFlag(t, "tls-cert", "proxy.crt")
+	setFlag(t, "tls-key", "")
+	if _, _, err := newListenerTLSConfig(); err == nil {
+		t.Error("-tls-cert without -tls-key accepted")
+	}
+}
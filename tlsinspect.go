@@ -0,0 +1,194 @@
+package main
+
+import "encoding/binary"
+
+// TLS record and handshake message types, see RFC 8446 section 5.1 and 4.
+const (
+	recordTypeHandshake = 22
+
+	handshakeTypeClientHello        = 1
+	handshakeTypeServerHello        = 2
+	handshakeTypeCertificateRequest = 13
+	handshakeTypeServerHelloDone    = 14
+)
+
+// maxObservedHandshake bounds how much of a stream tlsObserver buffers.
+const maxObservedHandshake = 64 * 1024
+
+// tlsObserver is an io.Writer that watches the start of a TLS byte stream,
+// typically through an io.TeeReader, and reports each plaintext handshake
+// message to onMessage. It never alters the stream and stops looking at the
+// first non-handshake record, since everything after that is encrypted.
+// Non-TLS streams are ignored.
+type tlsObserver struct {
+	onMessage func(msgType byte, body []byte)
+
+	records   []byte // bytes of incomplete records
+	handshake []byte // handshake bytes reassembled across records
+	done      bool
+}
+
+func newTLSObserver(onMessage func(msgType byte, body []byte)) *tlsObserver {
+	return &tlsObserver{onMessage: onMessage}
+}
+
+// Write feeds observed bytes to the parser. It always succeeds.
+func (o *tlsObserver) Write(p []byte) (int, error) {
+	if !o.done {
+		o.records = append(o.records, p...)
+		o.parse()
+	}
+	return len(p), nil
+}
+
+func (o *tlsObserver) parse() {
+	for len(o.records) >= 5 {
+		// type(1) version(2) length(2)
+		if o.records[0] != recordTypeHandshake || o.records[1] != 3 {
+			o.stop()
+			return
+		}
+		length := int(binary.BigEndian.Uint16(o.records[3:5]))
+		if len(o.records) < 5+length {
+			break
+		}
+		o.handshake = append(o.handshake, o.records[5:5+length]...)
+		o.records = o.records[5+length:]
+
+		for len(o.handshake) >= 4 {
+			// type(1) length(3)
+			msgLen := int(o.handshake[1])<<16 | int(o.handshake[2])<<8 | int(o.handshake[3])
+			if len(o.handshake) < 4+msgLen {
+				break
+			}
+			msgType := o.handshake[0]
+			o.onMessage(msgType, o.handshake[4:4+msgLen])
+			o.handshake = o.handshake[4+msgLen:]
+			if msgType == handshakeTypeServerHelloDone {
+				o.stop()
+				return
+			}
+		}
+	}
+	if len(o.records)+len(o.handshake) > maxObservedHandshake {
+		o.stop()
+	}
+}
+
+func (o *tlsObserver) stop() {
+	o.done = true
+	o.records = nil
+	o.handshake = nil
+}
+
+// TLS extension types, see RFC 6066 and RFC 8446 section 4.2.
+const (
+	extensionServerName        = 0
+	extensionSupportedVersions = 43
+)
+
+// maxTLSRecord is the largest TLS record a peer may send, including its
+// 5 byte header.
+const maxTLSRecord = 5 + 16384
+
+// parseSNI returns the host name from the server_name extension of a
+// ClientHello message body, or "" if there is none or the message is
+// malformed.
+func parseSNI(body []byte) string {
+	// legacy_version(2) random(32)
+	if len(body) < 34 {
+		return ""
+	}
+	b := body[34:]
+	// legacy_session_id, cipher_suites, legacy_compression_methods
+	for _, lenBytes := range []int{1, 2, 1} {
+		b = skipVector(b, lenBytes)
+		if b == nil {
+			return ""
+		}
+	}
+	if len(b) < 2 {
+		return ""
+	}
+	extensions := b[2:]
+	if n := int(binary.BigEndian.Uint16(b)); n <= len(extensions) {
+		extensions = extensions[:n]
+	}
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		extLen := int(binary.BigEndian.Uint16(extensions[2:]))
+		if len(extensions) < 4+extLen {
+			return ""
+		}
+		data := extensions[4 : 4+extLen]
+		extensions = extensions[4+extLen:]
+		if extType != extensionServerName || len(data) < 2 {
+			continue
+		}
+		// server_name_list: name_type(1) HostName<1..2^16-1>
+		list := data[2:]
+		for len(list) >= 3 {
+			nameType := list[0]
+			nameLen := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+nameLen {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return string(list[3 : 3+nameLen])
+			}
+			list = list[3+nameLen:]
+		}
+		return ""
+	}
+	return ""
+}
+
+// parseServerHello returns the protocol version and cipher suite a server
+// selected in a ServerHello message body. TLS 1.3 servers report their
+// version in the supported_versions extension.
+func parseServerHello(body []byte) (version, cipher uint16, ok bool) {
+	// legacy_version(2) random(32)
+	if len(body) < 34 {
+		return 0, 0, false
+	}
+	version = binary.BigEndian.Uint16(body)
+	b := skipVector(body[34:], 1) // legacy_session_id_echo
+	// cipher_suite(2) legacy_compression_method(1)
+	if len(b) < 3 {
+		return 0, 0, false
+	}
+	cipher = binary.BigEndian.Uint16(b)
+	b = b[3:]
+	if len(b) < 2 {
+		return version, cipher, true // no extensions
+	}
+	extensions := b[2:]
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		extLen := int(binary.BigEndian.Uint16(extensions[2:]))
+		if len(extensions) < 4+extLen {
+			break
+		}
+		if extType == extensionSupportedVersions && extLen == 2 {
+			version = binary.BigEndian.Uint16(extensions[4:])
+		}
+		extensions = extensions[4+extLen:]
+	}
+	return version, cipher, true
+}
+
+// skipVector skips a TLS vector with a length prefix of lenBytes bytes and
+// returns the rest of b, or nil if b is too short.
+func skipVector(b []byte, lenBytes int) []byte {
+	if len(b) < lenBytes {
+		return nil
+	}
+	n := 0
+	for _, c := range b[:lenBytes] {
+		n = n<<8 | int(c)
+	}
+	if len(b) < lenBytes+n {
+		return nil
+	}
+	return b[lenBytes+n:]
+}
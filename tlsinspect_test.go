@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTLSServer runs a TLS 1.2 server that answers each handshake and
+// closes the connection, with clientAuth as its client certificate policy.
+func startTLSServer(t *testing.T, clientAuth tls.ClientAuthType) string {
+	t.Helper()
+	_, _, pair := writeCert(t, t.TempDir(), "server")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   clientAuth,
+		MaxVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// handshakeThrough runs a TLS handshake with target through the proxy.
+func handshakeThrough(t *testing.T, proxy, target string) {
+	t.Helper()
+	conn, _, status := connect(t, proxy, target)
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT %s: status %d", target, status)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	tlsConn.Handshake()
+	tlsConn.Close()
+}
+
+func TestLogMTLS(t *testing.T) {
+	setFlag(t, "log-mtls", "true")
+	logs := captureLog(t)
+	proxy := startProxy(t, handleClientConnection)
+
+	handshakeThrough(t, proxy, startTLSServer(t, tls.NoClientCert))
+	handshakeThrough(t, proxy, startTLSServer(t, tls.RequestClientCert))
+	if !waitLogged(logs, "requested a client certificate (mutual TLS)") {
+		t.Fatalf("certificate request not logged; log: %s", logs)
+	}
+	if n := strings.Count(logs.String(), "requested a client certificate"); n != 1 {
+		t.Errorf("logged %d certificate requests, want 1; log: %s", n, logs)
+	}
+}
+
+func TestTLSObserverIgnoresPlaintext(t *testing.T) {
+	called := false
+	o := newTLSObserver(func(byte, []byte) { called = true })
+	o.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if called || !o.done {
+		t.Error("observer parsed a plaintext stream")
+	}
+}
+
+// readRecord reads a recorded TLS record from testdata.
+func readRecord(t *testing.T, name string) []byte {
+	t.Helper()
+	record, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestParseSNI(t *testing.T) {
+	// record header(5), handshake header(4)
+	body := readRecord(t, "clienthello.bin")[9:]
+	if sni := parseSNI(body); sni != "www.example.com" {
+		t.Errorf("parseSNI = %q, want www.example.com", sni)
+	}
+	for n := range body {
+		if sni := parseSNI(body[:n]); sni != "" && sni != "www.example.com" {
+			t.Fatalf("parseSNI of %d bytes = %q", n, sni)
+		}
+	}
+}
+
+func TestCheckSNI(t *testing.T) {
+	setFlag(t, "check-sni", "true")
+	ports, _ := parsePorts("443")
+	sniPorts = ports
+	t.Cleanup(func() { sniPorts = nil })
+	useBlacklist(t, "www.example.com")
+	useRewrites(t, "front.test="+startEcho(t))
+	proxy := startProxy(t, handleClientConnection)
+	hello := readRecord(t, "clienthello.bin")
+
+	for _, tt := range []struct {
+		target  string
+		relayed bool
+	}{
+		{"front.test:443", false},
+		// the server may speak first on other ports, so they aren't peeked at
+		{"front.test:8443", true},
+	} {
+		conn, reader, status := connect(t, proxy, tt.target)
+		if status != http.StatusOK {
+			t.Fatalf("CONNECT %s: status %d", tt.target, status)
+		}
+		conn.Write(hello)
+		buf := make([]byte, len(hello))
+		_, err := io.ReadFull(reader, buf)
+		if relayed := err == nil; relayed != tt.relayed {
+			t.Errorf("%s: ClientHello for a blacklisted name relayed %v, want %v", tt.target, relayed, tt.relayed)
+		}
+	}
+}
+
+func TestParseServerHello(t *testing.T) {
+	tests := []struct {
+		file    string
+		version uint16
+	}{
+		{"serverhello-tls12.bin", tls.VersionTLS12},
+		// TLS 1.3 reports its version in supported_versions
+		{"serverhello-tls13.bin", tls.VersionTLS13},
+	}
+	for _, tt := range tests {
+		body := readRecord(t, tt.file)[9:]
+		version, cipher, ok := parseServerHello(body)
+		if !ok || version != tt.version {
+			t.Errorf("%s: version %s, ok %v; want %s", tt.file, tls.VersionName(version), ok, tls.VersionName(tt.version))
+		}
+		if tls.CipherSuiteName(cipher) == fmt.Sprintf("0x%04X", cipher) {
+			t.Errorf("%s: unknown cipher suite %#04x", tt.file, cipher)
+		}
+		for n := 0; n < 38; n++ {
+			if _, _, ok := parseServerHello(body[:n]); ok {
+				t.Errorf("%s: %d bytes parsed", tt.file, n)
+			}
+		}
+	}
+}
+
+func TestLogTLS(t *testing.T) {
+	setFlag(t, "log-tls", "true")
+	logs := captureLog(t)
+	proxy := startProxy(t, handleClientConnection)
+
+	handshakeThrough(t, proxy, startTLSServer(t, tls.NoClientCert))
+	if !waitLogged(logs, ": TLS 1.2, TLS_") {
+		t.Errorf("TLS parameters not logged; log: %s", logs)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	otelEndpoint = flag.String("otel-endpoint", "", "OTLP/HTTP traces endpoint to export one span per connection to, e.g. http://localhost:4318/v1/traces")
+	otelInterval = flag.Duration("otel-interval", 5*time.Second, "interval between OTLP span exports")
+)
+
+// maxQueuedSpans bounds the spans waiting for export; more are dropped.
+const maxQueuedSpans = 4096
+
+// spanQueue holds finished spans until the next export; nil when tracing is
+// off, so connections pay nothing for it.
+var spanQueue chan otlpSpan
+
+// The OTLP types below cover the subset of the OTLP/HTTP JSON encoding of
+// ExportTraceServiceRequest that the proxy produces.
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 is a string in OTLP JSON
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"` // 2 server
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func stringAttr(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newSpan builds the span for a connection started at start. A connection
+// answered with an HTTP error status is marked as an error.
+func newSpan(stats Stats, start time.Time) otlpSpan {
+	span := otlpSpan{
+		TraceID:           randomHex(16),
+		SpanID:            randomHex(8),
+		Name:              "proxy.connection",
+		Kind:              2,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(start.Add(stats.Duration).UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			stringAttr("client.address", stats.ClientIP),
+			intAttr("proxy.bytes_in", stats.BytesIn),
+			intAttr("proxy.bytes_out", stats.BytesOut),
+			intAttr("http.response.status_code", int64(stats.Status)),
+		},
+		Status: otlpStatus{Code: 1},
+	}
+	if stats.Target != "" {
+		span.Attributes = append(span.Attributes, stringAttr("server.address", logHost(stats.Target)))
+	}
+	if stats.conn != nil {
+		span.Attributes = append(span.Attributes, intAttr("proxy.conn_id", int64(stats.conn.id)))
+	}
+	if stats.Status >= http.StatusBadRequest {
+		span.Status = otlpStatus{Code: 2, Message: "status " + strconv.Itoa(stats.Status)}
+	}
+	return span
+}
+
+// recordSpan queues the span of a finished connection for export.
+func recordSpan(stats Stats, start time.Time) {
+	if spanQueue == nil {
+		return
+	}
+	select {
+	case spanQueue <- newSpan(stats, start):
+	default: // the exporter is falling behind; drop the span
+	}
+}
+
+// exportSpans posts the queued spans to url every interval. It never returns.
+func exportSpans(url string, interval time.Duration) {
+	client := &http.Client{Timeout: interval}
+	resource := []otlpAttribute{stringAttr("service.name", "go-minimal-proxy")}
+
+	for range time.Tick(interval) {
+		var spans []otlpSpan
+	drain:
+		for {
+			select {
+			case span := <-spanQueue:
+				spans = append(spans, span)
+			default:
+				break drain
+			}
+		}
+		if len(spans) == 0 {
+			continue
+		}
+
+		body, _ := json.Marshal(map[string]any{
+			"resourceSpans": []any{map[string]any{
+				"resource": map[string]any{"attributes": resource},
+				"scopeSpans": []any{map[string]any{
+					"scope": map[string]any{"name": "go-minimal-proxy", "version": version},
+					"spans": spans,
+				}},
+			}},
+		})
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error exporting %d spans: %v", len(spans), err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Printf("Error exporting %d spans: %s", len(spans), resp.Status)
+		}
+	}
+}
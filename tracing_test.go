@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spanAttr returns the JSON of the attribute key of span, or "".
+func spanAttr(span otlpSpan, key string) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			value, _ := json.Marshal(attr.Value)
+			return string(value)
+		}
+	}
+	return ""
+}
+
+func TestNewSpan(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	span := newSpan(Stats{
+		ClientIP: "10.0.0.1",
+		Target:   "example.com:443",
+		BytesIn:  10,
+		BytesOut: 20,
+		Status:   200,
+		Duration: 1500 * time.Millisecond,
+	}, start)
+
+	if len(span.TraceID) != 32 || len(span.SpanID) != 16 || span.Kind != 2 {
+		t.Errorf("span ids/kind: %+v", span)
+	}
+	if span.StartTimeUnixNano != "1700000000000000000" || span.EndTimeUnixNano != "1700000001500000000" {
+		t.Errorf("span times %s-%s", span.StartTimeUnixNano, span.EndTimeUnixNano)
+	}
+	for key, want := range map[string]string{
+		"client.address":            `{"stringValue":"10.0.0.1"}`,
+		"server.address":            `{"stringValue":"example.com:443"}`,
+		"proxy.bytes_in":            `{"intValue":"10"}`,
+		"http.response.status_code": `{"intValue":"200"}`,
+	} {
+		if got := spanAttr(span, key); got != want {
+			t.Errorf("%s = %s, want %s", key, got, want)
+		}
+	}
+	if span.Status.Code != 1 {
+		t.Errorf("status %+v, want ok", span.Status)
+	}
+
+	if span := newSpan(Stats{Status: 502}, start); span.Status.Code != 2 || span.Status.Message != "status 502" {
+		t.Errorf("502 span status %+v, want an error", span.Status)
+	}
+}
+
+func TestSpanRecordedPerConnection(t *testing.T) {
+	spanQueue = make(chan otlpSpan, 1)
+	t.Cleanup(func() { spanQueue = nil })
+	proxy := startProxy(t, handleClientConnection)
+
+	sendRaw(t, proxy, "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	select {
+	case span := <-spanQueue:
+		if span.Name != "proxy.connection" || !strings.Contains(spanAttr(span, "http.response.status_code"), `"405"`) {
+			t.Errorf("span %+v", span)
+		}
+		if spanAttr(span, "proxy.conn_id") == "" {
+			t.Error("span has no conn id")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no span recorded")
+	}
+
+	// a full queue drops spans instead of blocking the handler
+	recordSpan(Stats{}, time.Now())
+	recordSpan(Stats{}, time.Now())
+	if len(spanQueue) != 1 {
+		t.Errorf("%d spans queued, want 1", len(spanQueue))
+	}
+}
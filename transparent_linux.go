@@ -0,0 +1,72 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h. The same value
+// is used for IP6T_SO_ORIGINAL_DST at the IPv6 level.
+const soOriginalDst = 80
+
+// transparentSupported reports whether -transparent can work on this platform.
+const transparentSupported = true
+
+// controlFD runs fn with the raw file descriptor of conn without duplicating it.
+func controlFD(conn *net.TCPConn, fn func(fd uintptr)) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return raw.Control(fn)
+}
+
+// originalDst returns the destination a connection was addressed to before an
+// iptables REDIRECT/DNAT rule sent it to this proxy.
+func originalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := unwrapConn(conn).(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("original destination: not a TCP connection (%T)", conn)
+	}
+
+	var addr string
+	var sockErr error
+	err := controlFD(tcpConn, func(fd uintptr) {
+		local, _ := tcpConn.LocalAddr().(*net.TCPAddr)
+		if local != nil && local.IP.To4() == nil {
+			// sockaddr_in6 is returned in the first 28 bytes of IPv6MTUInfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			// the port is stored in network byte order inside a native uint16
+			var portBytes [2]byte
+			binary.NativeEndian.PutUint16(portBytes[:], info.Addr.Port)
+			port := binary.BigEndian.Uint16(portBytes[:])
+			addr = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), fmt.Sprint(port))
+			return
+		}
+
+		// sockaddr_in is returned in the 16 bytes of an IPv6Mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		raw := mreq.Multiaddr
+		port := binary.BigEndian.Uint16(raw[2:4])
+		addr = net.JoinHostPort(net.IPv4(raw[4], raw[5], raw[6], raw[7]).String(), fmt.Sprint(port))
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return addr, nil
+}
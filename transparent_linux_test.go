@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDstNeedsTCP(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := originalDst(server); err == nil {
+		t.Error("originalDst of a pipe succeeded, want an error")
+	}
+}
+
+func TestOriginalDstOfUnredirectedConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// without netfilter the option is missing; with conntrack but no
+	// redirect the original destination is the listener itself
+	addr, err := originalDst(&closeOnceConn{Conn: conn})
+	if err == nil && addr != listener.Addr().String() {
+		t.Errorf("originalDst = %s, want %s", addr, listener.Addr())
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// errTransparentUnsupported is returned by originalDst on platforms without
+// SO_ORIGINAL_DST. Transparent mode relies on Linux netfilter to redirect
+// connections and to remember where they were going.
+var errTransparentUnsupported = errors.New("transparent mode is only supported on linux")
+
+// transparentSupported reports whether -transparent can work on this platform.
+const transparentSupported = false
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", errTransparentUnsupported
+}
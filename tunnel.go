@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// observedConn tees everything read from a connection into an observer.
+type observedConn struct {
+	net.Conn
+	observer io.Writer
+}
+
+// Read reads from the underlying net.Conn and passes the bytes to observer.
+func (c *observedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.observer.Write(b[:n])
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection.
+func (c *observedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// idleConn pushes the connection's deadline out by timeout on every
+// successful Read or Write, so a connection without traffic for timeout fails
+// with a deadline error. Once a read deadline is set explicitly, as Tunnel
+// does to stop a copy, activity no longer moves it.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mu     sync.Mutex
+	pinned bool
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) *idleConn {
+	c := &idleConn{Conn: conn, timeout: timeout}
+	c.touch()
+	return c
+}
+
+func (c *idleConn) touch() {
+	c.mu.Lock()
+	if !c.pinned {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	c.mu.Unlock()
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// SetReadDeadline sets the read deadline and stops activity from moving it.
+func (c *idleConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pinned = true
+	return c.Conn.SetReadDeadline(t)
+}
+
+// NetConn returns the wrapped connection.
+func (c *idleConn) NetConn() net.Conn {
+	return c.Conn
+}
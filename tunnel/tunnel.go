@@ -0,0 +1,162 @@
+// Package tunnel relays bytes between two connections the way the proxy does
+// for a CONNECT tunnel, so a program with its own accept loop can embed it.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by Tunnel when a direction moved more than
+// Options.Limit bytes.
+var ErrQuotaExceeded = errors.New("byte quota exceeded")
+
+// Stats describes a finished tunnel. BytesIn counts the bytes read from the
+// client, BytesOut the bytes written to it.
+type Stats struct {
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+}
+
+// Options configure a tunnel. The zero value has no byte limit and copies
+// with io.Copy.
+type Options struct {
+	// Limit caps the bytes moved in each direction; 0 means no limit.
+	Limit int64
+	// Copy copies one direction; nil means io.Copy.
+	Copy func(dst io.Writer, src io.Reader) (int64, error)
+}
+
+// Tunnel relays between client and target with the zero Options.
+func Tunnel(ctx context.Context, client, target net.Conn) (Stats, error) {
+	return Options{}.Tunnel(ctx, client, target)
+}
+
+// Tunnel copies data between client and target until target stops sending,
+// either side moves more than o.Limit bytes, or ctx is canceled. When the
+// client finishes sending first, the target's write side is closed and its
+// response is still relayed. Both copy goroutines have exited when Tunnel
+// returns. Both connections are closed when ctx is canceled; otherwise
+// closing them is left to the caller. Tunnel reports the bytes moved and
+// returns ErrQuotaExceeded if the limit ended the tunnel.
+func (o Options) Tunnel(ctx context.Context, client, target net.Conn) (Stats, error) {
+	start := time.Now()
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+		target.Close()
+	})
+	defer stop()
+
+	copyFn := o.Copy
+	if copyFn == nil {
+		copyFn = io.Copy
+	}
+	clientCounting := &countingConn{Conn: client, limit: o.Limit}
+	targetCounting := &countingConn{Conn: target, limit: o.Limit}
+
+	var quotaHit atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// the caller's recover doesn't reach this goroutine
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic in tunnel copy: %v\n%s", r, debug.Stack())
+				target.Close()
+			}
+		}()
+		_, err := copyFn(targetCounting, clientCounting)
+		switch {
+		case err == nil:
+			// the client is done sending, but may still wait for a response
+			CloseWrite(target)
+		case errors.Is(err, ErrQuotaExceeded):
+			quotaHit.Store(true)
+			target.Close() // unblocks the copy below
+		default:
+			target.Close()
+		}
+	}()
+	_, err := copyFn(clientCounting, targetCounting)
+	if errors.Is(err, ErrQuotaExceeded) {
+		quotaHit.Store(true)
+	}
+
+	// the target is done; unblock the other copy if it still waits on the client
+	client.SetReadDeadline(time.Now())
+	wg.Wait()
+
+	stats := Stats{
+		BytesIn:  atomic.LoadInt64(&clientCounting.bytesRead),
+		BytesOut: atomic.LoadInt64(&clientCounting.bytesWritten),
+		Duration: time.Since(start),
+	}
+	if quotaHit.Load() {
+		return stats, ErrQuotaExceeded
+	}
+	return stats, nil
+}
+
+// CloseWrite shuts down the writing side of conn, or of the first connection
+// beneath its wrappers that supports it, such as *net.TCPConn or *tls.Conn.
+// Wrappers are unwrapped through a NetConn method.
+func CloseWrite(conn net.Conn) error {
+	for {
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			return cw.CloseWrite()
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// countingConn counts the bytes read and written and caps each direction at
+// a non-zero limit.
+type countingConn struct {
+	net.Conn
+	bytesWritten int64
+	bytesRead    int64
+	limit        int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	if c.limit > 0 && atomic.LoadInt64(&c.bytesWritten)+int64(len(b)) > c.limit {
+		return 0, ErrQuotaExceeded
+	}
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.bytesWritten, int64(n))
+	return n, err
+}
+
+// Read shortens reads so the limit is never overshot.
+func (c *countingConn) Read(b []byte) (int, error) {
+	if c.limit > 0 {
+		remaining := c.limit - atomic.LoadInt64(&c.bytesRead)
+		if remaining <= 0 {
+			return 0, ErrQuotaExceeded
+		}
+		if int64(len(b)) > remaining {
+			b = b[:remaining]
+		}
+	}
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesRead, int64(n))
+	return n, err
+}
+
+// NetConn returns the wrapped connection.
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,241 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startEcho runs a TCP server that echoes what it reads and returns its
+// address.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTunnel(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	target, targetEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer targetEnd.Close()
+
+	// the target answers the request, then closes
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(targetEnd, buf)
+		targetEnd.Write([]byte("response"))
+		targetEnd.Close()
+	}()
+	go clientEnd.Write([]byte("hello"))
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(clientEnd)
+		received <- data
+	}()
+
+	stats, err := Tunnel(context.Background(), client, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if data := <-received; string(data) != "response" {
+		t.Errorf("client received %q", data)
+	}
+	if stats.BytesIn != 5 || stats.BytesOut != 8 {
+		t.Errorf("stats in=%d out=%d, want 5 and 8", stats.BytesIn, stats.BytesOut)
+	}
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	echo := startEcho(t)
+	target, err := net.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	client, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+
+	// the client sends and stops; the echoed reply must still arrive
+	go func() {
+		clientEnd.Write([]byte("ping"))
+		clientEnd.Close()
+	}()
+	stats, err := Tunnel(context.Background(), &halfClosePipe{Conn: client}, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesOut != 4 {
+		t.Errorf("relayed %d bytes of the reply, want 4", stats.BytesOut)
+	}
+}
+
+// halfClosePipe ignores writes once the other end of a net.Pipe has gone,
+// like a half-closed TCP connection whose reply is discarded.
+type halfClosePipe struct{ net.Conn }
+
+func (c *halfClosePipe) Write(b []byte) (int, error) {
+	c.Conn.Write(b)
+	return len(b), nil
+}
+
+func TestTunnelCanceled(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	target, targetEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer targetEnd.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	done := make(chan struct{})
+	go func() {
+		Tunnel(ctx, client, target)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel still running after ctx was canceled")
+	}
+	if _, err := clientEnd.Write([]byte("x")); err == nil {
+		t.Error("client still open")
+	}
+}
+
+func TestTunnelLimit(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	target, targetEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer targetEnd.Close()
+
+	go io.Copy(io.Discard, targetEnd)
+	go clientEnd.Write(make([]byte, 1000))
+	_, err := Options{Limit: 100}.Tunnel(context.Background(), client, target)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("err = %v, want ErrQuotaExceeded", err)
+	}
+}
+
+func TestTunnelLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		client, clientEnd := net.Pipe()
+		target, targetEnd := net.Pipe()
+		// the target hangs up while the client is still connected
+		go targetEnd.Close()
+		Tunnel(context.Background(), client, target)
+		client.Close()
+		clientEnd.Close()
+	}
+	// tunnel itself joins its copy goroutine; allow the closers above to exit
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines after 20 tunnels, %d before", after, before)
+	}
+}
+
+func TestTunnelJoinsCopyGoroutine(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	target, targetEnd := net.Pipe()
+	defer clientEnd.Close()
+	go targetEnd.Close()
+
+	before := runtime.NumGoroutine()
+	Tunnel(context.Background(), client, target)
+	// no sleep: the client-to-target copy must be gone when tunnel returns
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines after tunnel returned, %d before", after, before)
+	}
+}
+
+// panickingConn panics on Read.
+type panickingConn struct{ net.Conn }
+
+func (panickingConn) Read([]byte) (int, error) { panic("read") }
+
+func TestTunnelRecoversCopyPanic(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	client, clientEnd := net.Pipe()
+	target, targetEnd := net.Pipe()
+	defer clientEnd.Close()
+	go io.Copy(io.Discard, targetEnd)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Tunnel(context.Background(), panickingConn{client}, target)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel hangs after a panic in the copy goroutine")
+	}
+	if !strings.Contains(logs.String(), "Panic in tunnel copy: read") {
+		t.Errorf("panic not logged; log: %s", logs.String())
+	}
+}
+
+func TestCountingConnLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write(make([]byte, 300))
+		client.Close()
+	}()
+
+	conn := &countingConn{Conn: server, limit: 100}
+	n, err := io.Copy(io.Discard, conn)
+	if n != 100 || !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("read %d bytes, err %v; want 100 bytes and ErrQuotaExceeded", n, err)
+	}
+	if _, err := conn.Write(make([]byte, 101)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("write over the limit: err %v, want ErrQuotaExceeded", err)
+	}
+}
+
+func TestOptionsCopy(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	target, targetEnd := net.Pipe()
+	defer clientEnd.Close()
+	go targetEnd.Close()
+
+	var calls atomic.Int32
+	copyFn := func(dst io.Writer, src io.Reader) (int64, error) {
+		calls.Add(1)
+		return io.Copy(dst, src)
+	}
+	Options{Copy: copyFn}.Tunnel(context.Background(), client, target)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Copy called %d times, want once per direction", n)
+	}
+}
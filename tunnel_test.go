@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainClosesTunnelsAfterTimeout(t *testing.T) {
+	t.Cleanup(func() { tunnelCtx, stopTunnels = context.WithCancel(context.Background()) })
+	proxy := startProxy(t, handleClientConnection)
+	conn, reader, status := connect(t, proxy, startEcho(t))
+	if status != 200 {
+		t.Fatalf("CONNECT: status %d", status)
+	}
+
+	// an idle tunnel survives shutdown until the drain timeout
+	start := time.Now()
+	drain(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("drain returned after %v, before its timeout", elapsed)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("tunnel read: %v, want EOF once the tunnel was closed", err)
+	}
+}
+
+func TestMaxConnDuration(t *testing.T) {
+	setFlag(t, "max-conn-duration", "200ms")
+	logs := captureLog(t)
+	proxy := startProxy(t, handleClientConnection)
+	conn, reader, status := connect(t, proxy, startEcho(t))
+	if status != 200 {
+		t.Fatalf("CONNECT: status %d", status)
+	}
+
+	// keep data flowing; the tunnel is closed anyway
+	start := time.Now()
+	go func() {
+		for {
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	io.Copy(io.Discard, reader)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("tunnel closed after %v, want about 200ms", elapsed)
+	}
+	if !waitLogged(logs, "reached -max-conn-duration") {
+		t.Errorf("closing not logged; log: %s", logs)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	setFlag(t, "idle-timeout", "150ms")
+	proxy := startProxy(t, handleClientConnection)
+	conn, reader, status := connect(t, proxy, startEcho(t))
+	if status != 200 {
+		t.Fatalf("CONNECT: status %d", status)
+	}
+
+	// traffic keeps the tunnel open past the timeout
+	buf := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		time.Sleep(75 * time.Millisecond)
+		conn.Write([]byte("x"))
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Fatalf("active tunnel closed after %d round trips: %v", i, err)
+		}
+	}
+
+	// silence closes it
+	start := time.Now()
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("idle tunnel read: %v, want EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("idle tunnel closed after %v", elapsed)
+	}
+}
+
+func TestIdleConnDeadlinePinned(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := newIdleConn(client, time.Hour)
+	go server.Write([]byte("data"))
+
+	// an explicit read deadline isn't moved by later activity
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 4)
+	conn.Read(buf)
+	start := time.Now()
+	if _, err := conn.Read(buf); err == nil || time.Since(start) > time.Second {
+		t.Errorf("read after the pinned deadline: %v after %v", err, time.Since(start))
+	}
+}
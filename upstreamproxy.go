@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	respectEnvProxy = flag.Bool("respect-env-proxy", false, "chain tunnels through the proxy in HTTPS_PROXY/HTTP_PROXY, honoring NO_PROXY")
+	checkUpstream   = flag.String("check-upstream", "", `test-dial the upstream proxies from -rules and the environment at startup: "warn" logs failures, "exit" also exits with status 1`)
+)
+
+// envProxyURL returns the proxy the environment selects for a tunnel to
+// hostPort, or nil for a direct connection. Tunnels are treated as https
+// requests, so HTTPS_PROXY applies; NO_PROXY exclusions are honored.
+func envProxyURL(hostPort string) (*url.URL, error) {
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: hostPort}}
+	return http.ProxyFromEnvironment(req)
+}
+
+// dialViaProxy opens a tunnel to hostPort through the HTTP(S) proxy at
+// proxyURL using CONNECT.
+func dialViaProxy(ctx context.Context, proxyURL *url.URL, hostPort string) (net.Conn, error) {
+	var defaultPort string
+	switch proxyURL.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", proxyURL.Scheme)
+	}
+
+	ctx, cancel := withDialTimeout(ctx)
+	defer cancel()
+	raw, err := dialDirect(ctx, withDefaultPort(proxyURL.Host, defaultPort))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: hostPort},
+		Host:   hostPort,
+		Header: http.Header{"Via": {"1.1 " + proxyAgent()}},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	conn := raw
+	var reader *bufio.Reader
+	err = upstreamHandshake(ctx, raw, func() error {
+		if proxyURL.Scheme == "https" {
+			tlsConn := tls.Client(raw, upstreamTLSConfig(proxyURL))
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return err
+			}
+			conn = tlsConn
+		}
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+		reader = bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("upstream proxy %s: %s", proxyURL.Host, resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if reader.Buffered() == 0 {
+		return conn, nil
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// withDialTimeout bounds ctx by -dial-timeout, so that a dial through an
+// upstream proxy spends one budget on both the connection and the handshake.
+func withDialTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *dialTimeout > 0 {
+		return context.WithTimeout(ctx, *dialTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// upstreamHandshake runs handshake on conn, a new connection to an upstream
+// proxy. conn gets ctx's deadline and is closed if ctx ends first, so a
+// stalled proxy can't hold the handler. The deadline is cleared again after
+// a successful handshake.
+func upstreamHandshake(ctx context.Context, conn net.Conn, handshake func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err := handshake()
+	if !stop() {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// upstreamTLSConfig returns the TLS config for the hop to a TLS upstream
+// proxy. The server name is the URL's host unless overridden with an "sni"
+// query parameter, e.g. socks5s://10.0.0.1:1080?sni=proxy.example.com.
+func upstreamTLSConfig(proxyURL *url.URL) *tls.Config {
+	serverName := proxyURL.Hostname()
+	if sni := proxyURL.Query().Get("sni"); sni != "" {
+		serverName = sni
+	}
+	return &tls.Config{ServerName: serverName, RootCAs: upstreamRootCAs}
+}
+
+// upstreamProxies returns the upstream proxies the proxy may chain through:
+// those in -rules and, with -respect-env-proxy, the environment's.
+func upstreamProxies() []*url.URL {
+	var proxies []*url.URL
+	seen := make(map[string]bool)
+	add := func(u *url.URL) {
+		if u != nil && !seen[u.String()] {
+			seen[u.String()] = true
+			proxies = append(proxies, u)
+		}
+	}
+	for _, route := range routes {
+		add(route.upstream)
+	}
+	if *respectEnvProxy {
+		// any host NO_PROXY doesn't exclude will do
+		proxyURL, err := envProxyURL("example.com:443")
+		if err == nil {
+			add(proxyURL)
+		}
+	}
+	return proxies
+}
+
+// checkUpstreams test-dials every upstream proxy within -dial-timeout,
+// completing the TLS handshake for TLS upstreams, and logs the results. It
+// returns the number of unreachable upstreams.
+func checkUpstreams(ctx context.Context) int {
+	failed := 0
+	for _, proxyURL := range upstreamProxies() {
+		err := checkUpstreamProxy(ctx, proxyURL)
+		if err != nil {
+			log.Printf("Upstream proxy %s is unreachable: %v", proxyURL.Redacted(), err)
+			failed++
+			continue
+		}
+		log.Printf("Upstream proxy %s is reachable", proxyURL.Redacted())
+	}
+	return failed
+}
+
+func checkUpstreamProxy(ctx context.Context, proxyURL *url.URL) error {
+	if *dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *dialTimeout)
+		defer cancel()
+	}
+	defaultPort := "1080"
+	switch proxyURL.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	}
+	conn, err := dialDirect(ctx, withDefaultPort(proxyURL.Host, defaultPort))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if proxyURL.Scheme == "https" || proxyURL.Scheme == "socks5s" {
+		return tls.Client(conn, upstreamTLSConfig(proxyURL)).HandshakeContext(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUpstreamProxy runs a stub HTTP proxy that answers each CONNECT with
+// 200, sends the request on requests and then echoes the tunnel.
+func startUpstreamProxy(t *testing.T) (string, <-chan *http.Request) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan *http.Request, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				requests <- req
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(conn, reader)
+			}()
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+// TestEnvProxy runs itself in a child process: net/http caches the proxy
+// environment on first use, and other tests make HTTP requests earlier.
+func TestEnvProxy(t *testing.T) {
+	if os.Getenv("TEST_ENV_PROXY_CHILD") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestEnvProxy$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "TEST_ENV_PROXY_CHILD=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	upstream, requests := startUpstreamProxy(t)
+	t.Setenv("HTTPS_PROXY", "http://"+upstream)
+	t.Setenv("NO_PROXY", "direct.example")
+	setFlag(t, "respect-env-proxy", "true")
+
+	proxyURL, _ := envProxyURL("remote.example:443")
+	if proxyURL == nil {
+		t.Fatalf("envProxyURL = nil, want %s", upstream)
+	}
+	if direct, _ := envProxyURL("direct.example:443"); direct != nil {
+		t.Errorf("NO_PROXY host proxied through %s", direct)
+	}
+
+	conn, err := dialTarget(context.Background(), "remote.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := <-requests
+	if req.Method != "CONNECT" || req.Host != "remote.example:443" {
+		t.Errorf("upstream got %s %s, want CONNECT remote.example:443", req.Method, req.Host)
+	}
+	if req.Header.Get("Via") != "1.1 "+proxyAgent() {
+		t.Errorf("Via = %q", req.Header.Get("Via"))
+	}
+
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("tunnel through the upstream: %q, %v", buf, err)
+	}
+}
+
+func TestCheckUpstreams(t *testing.T) {
+	reachable, _ := startUpstreamProxy(t)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	unreachable := listener.Addr().String()
+	listener.Close()
+	useRules(t, `
+a.example  http://`+reachable+`
+b.example  http://user:secret@`+unreachable+`
+c.example  http://`+reachable+`
+d.example  direct
+`)
+	logs := captureLog(t)
+
+	if failed := checkUpstreams(context.Background()); failed != 1 {
+		t.Errorf("%d upstreams failed, want 1", failed)
+	}
+	if strings.Count(logs.String(), "is reachable") != 1 {
+		t.Errorf("want the shared upstream checked once; log: %s", logs)
+	}
+	if !logged(logs, "Upstream proxy http://user:xxxxx@"+unreachable+" is unreachable") {
+		t.Errorf("unreachable upstream not logged with its password redacted; log: %s", logs)
+	}
+}
+
+// startStalledUpstream accepts connections and never answers them.
+func startStalledUpstream(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestStalledUpstreamHandshake(t *testing.T) {
+	setFlag(t, "dial-timeout", "200ms")
+	stalled := startStalledUpstream(t)
+	for _, scheme := range []string{"http", "https", "socks5", "socks5s"} {
+		proxyURL, _ := url.Parse(scheme + "://" + stalled)
+		start := time.Now()
+		var err error
+		if strings.HasPrefix(scheme, "socks") {
+			_, err = dialViaSOCKS(context.Background(), proxyURL, "example.com:443")
+		} else {
+			_, err = dialViaProxy(context.Background(), proxyURL, "example.com:443")
+		}
+		if err == nil {
+			t.Errorf("%s: handshake with a silent upstream succeeded", scheme)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: gave up after %v, want about -dial-timeout", scheme, elapsed)
+		}
+	}
+}
+
+func TestStalledUpstreamCanceled(t *testing.T) {
+	setFlag(t, "dial-timeout", "0")
+	proxyURL, _ := url.Parse("http://" + startStalledUpstream(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := dialViaProxy(ctx, proxyURL, "example.com:443")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned %v after the cancel", elapsed)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+var showVersion = flag.Bool("version", false, "print version information and exit")
+
+// proxyAgent identifies this build in Proxy-agent and Via headers.
+func proxyAgent() string {
+	return "go-tunnel-proxy/" + version
+}
+
+func versionString() string {
+	return fmt.Sprintf("go-minimal-proxy %s (commit %s, built %s)", version, commit, buildDate)
+}
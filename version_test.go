@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVersionString(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.2.0", "abc1234", "2024-03-05T14:07:09Z"
+
+	if got, want := versionString(), "go-minimal-proxy 1.2.0 (commit abc1234, built 2024-03-05T14:07:09Z)"; got != want {
+		t.Errorf("versionString() = %q, want %q", got, want)
+	}
+	if got := proxyAgent(); got != "go-tunnel-proxy/1.2.0" {
+		t.Errorf("proxyAgent() = %q", got)
+	}
+}
+
+func TestConnectResponseNamesVersion(t *testing.T) {
+	proxy := startProxy(t, handleClientConnection)
+	echo := startEcho(t)
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Proxy-Agent"); got != proxyAgent() {
+		t.Errorf("Proxy-agent = %q, want %q", got, proxyAgent())
+	}
+	if got := resp.Header.Get("Via"); got != "1.1 "+proxyAgent() {
+		t.Errorf("Via = %q", got)
+	}
+}